@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	accessLogNone   = "none"
+	accessLogJSON   = "json"
+	accessLogLogfmt = "logfmt"
+)
+
+var accessLogLevels = map[string]int{
+	"info":  0,
+	"warn":  1,
+	"error": 2,
+}
+
+// accessRecord is a single access log entry, fields are emitted in this order
+type accessRecord struct {
+	Time      string  `json:"time"`
+	Level     string  `json:"level"`
+	Remote    string  `json:"remote"`
+	Method    string  `json:"method"`
+	Host      string  `json:"host"`
+	Path      string  `json:"path"`
+	Repo      string  `json:"repo"`
+	UserAgent string  `json:"user_agent"`
+	GoGet     bool    `json:"go_get"`
+	Status    int     `json:"status"`
+	Duration  float64 `json:"duration"`
+}
+
+// accessLogger writes access records to stderr or to a file that is reopened
+// on SIGUSR1 so that it can be rotated externally
+type accessLogger struct {
+	format  string
+	level   int
+	trusted []*net.IPNet
+
+	mu   sync.Mutex
+	name string
+	out  io.Writer
+}
+
+func newAccessLogger(format, level, name, trustedProxies string) (*accessLogger, error) {
+	if format != accessLogJSON && format != accessLogLogfmt {
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+
+	lvl, ok := accessLogLevels[level]
+	if !ok {
+		return nil, fmt.Errorf("unknown access log level %q", level)
+	}
+
+	trusted, err := parseCIDRs(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	l := accessLogger{
+		format:  format,
+		level:   lvl,
+		trusted: trusted,
+		name:    name,
+		out:     os.Stderr,
+	}
+
+	if len(name) == 0 {
+		return &l, nil
+	}
+
+	if err = l.reopen(); err != nil {
+		return nil, err
+	}
+
+	go l.watch()
+
+	return &l, nil
+}
+
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var ret []*net.IPNet
+
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, n)
+	}
+
+	return ret, nil
+}
+
+func (l *accessLogger) reopen() error {
+	f, err := os.OpenFile(l.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	old := l.out
+	l.out = f
+	l.mu.Unlock()
+
+	if c, ok := old.(*os.File); ok && c != os.Stderr {
+		_ = c.Close()
+	}
+
+	return nil
+}
+
+func (l *accessLogger) watch() {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+
+	for range usr1 {
+		if err := l.reopen(); err != nil {
+			log.Printf("error reopening access log %s: %v", l.name, err)
+			continue
+		}
+		log.Printf("reopened access log %s", l.name)
+	}
+}
+
+func (l *accessLogger) trustedProxy(ip net.IP) bool {
+	for _, n := range l.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteAddr returns the client address of r. X-Forwarded-For is only
+// honored when the connection comes from a trusted proxy, in which case the
+// rightmost untrusted address is the client.
+func (l *accessLogger) remoteAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !l.trustedProxy(ip) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+
+		hopIP := net.ParseIP(hop)
+		if hopIP == nil {
+			break
+		}
+
+		host = hop
+		if !l.trustedProxy(hopIP) {
+			break
+		}
+	}
+
+	return host
+}
+
+func (l *accessLogger) log(rec accessRecord) {
+	var buf bytes.Buffer
+
+	switch l.format {
+	case accessLogJSON:
+		_ = json.NewEncoder(&buf).Encode(rec)
+	default:
+		fmt.Fprintf(&buf, "time=%s level=%s remote=%s method=%s host=%s path=%s repo=%s user_agent=%s go_get=%t status=%d duration=%s\n",
+			logfmtValue(rec.Time),
+			logfmtValue(rec.Level),
+			logfmtValue(rec.Remote),
+			logfmtValue(rec.Method),
+			logfmtValue(rec.Host),
+			logfmtValue(rec.Path),
+			logfmtValue(rec.Repo),
+			logfmtValue(rec.UserAgent),
+			rec.GoGet,
+			rec.Status,
+			strconv.FormatFloat(rec.Duration, 'f', -1, 64),
+		)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := buf.WriteTo(l.out); err != nil {
+		log.Printf("error writing access log: %v", err)
+	}
+}
+
+func logfmtValue(v string) string {
+	if len(v) == 0 {
+		return `""`
+	}
+
+	if strings.ContainsAny(v, " =\"\\") || strings.IndexFunc(v, func(r rune) bool { return r < ' ' || r > '~' }) >= 0 {
+		return strconv.Quote(v)
+	}
+
+	return v
+}
+
+func statusLevel(code int) string {
+	switch {
+	case code >= http.StatusInternalServerError:
+		return "error"
+	case code >= http.StatusBadRequest:
+		return "warn"
+	default:
+		return "info"
+	}
+}
+
+// handler logs every request served by next at or above the configured level
+func (l *accessLogger) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := newStatusRecorder(w)
+
+		next.ServeHTTP(rec, r)
+
+		level := statusLevel(rec.code())
+		if accessLogLevels[level] < l.level {
+			return
+		}
+
+		l.log(accessRecord{
+			Time:      start.UTC().Format(time.RFC3339Nano),
+			Level:     level,
+			Remote:    l.remoteAddr(r),
+			Method:    r.Method,
+			Host:      r.Host,
+			Path:      r.URL.Path,
+			Repo:      rec.repo,
+			UserAgent: r.UserAgent(),
+			GoGet:     r.URL.Query().Get("go-get") == "1",
+			Status:    rec.code(),
+			Duration:  time.Since(start).Seconds(),
+		})
+	})
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	stdcontext "context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeHosts returns the hostnames certificates may be requested for
+func acmeHosts(c config) []string {
+	var ret []string
+
+	if host := importHost(c.ImportPrefix); len(host) > 0 {
+		ret = append(ret, host)
+	}
+
+	for _, h := range c.Hosts {
+		ret = append(ret, h.Host)
+	}
+
+	return ret
+}
+
+// hostPolicy allows certificates for the hosts of the current configuration
+// so that hosts added by a reload don't require a restart
+func hostPolicy(ctx stdcontext.Context, host string) error {
+	return autocert.HostWhitelist(acmeHosts(configs.current().config)...)(ctx, host)
+}
+
+func acmeManager() (*autocert.Manager, error) {
+	if len(acmeHosts(cfg)) == 0 {
+		return nil, fmt.Errorf("acme requires import-prefix or hosts to be set")
+	}
+
+	client := &acme.Client{
+		DirectoryURL: cfg.ACMEDirectoryURL,
+	}
+
+	if len(cfg.ACMECAFile) > 0 {
+		pem, err := ioutil.ReadFile(cfg.ACMECAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.ACMECAFile)
+		}
+
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}
+	}
+
+	m := autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: hostPolicy,
+		Email:      cfg.ACMEEmail,
+		Client:     client,
+	}
+
+	if len(cfg.ACMECacheDir) > 0 {
+		m.Cache = autocert.DirCache(cfg.ACMECacheDir)
+	} else {
+		log.Printf("WARNING: acme-cache-dir is not set, certificates will be requested again on every restart")
+	}
+
+	return &m, nil
+}
+
+// acmeCerts serves the certificates of an acme manager and keeps track of
+// them so that their validity and expiry can be reported
+type acmeCerts struct {
+	m *autocert.Manager
+
+	mu    sync.Mutex
+	leafs map[string]*x509.Certificate
+}
+
+func newACMECerts(m *autocert.Manager) *acmeCerts {
+	return &acmeCerts{
+		m:     m,
+		leafs: map[string]*x509.Certificate{},
+	}
+}
+
+func (a *acmeCerts) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := a.m.GetCertificate(hello)
+	if err != nil || cert.Leaf == nil || len(hello.ServerName) == 0 {
+		return cert, err
+	}
+
+	// tls-alpn-01 challenge certificates are only served to the ca
+	for _, proto := range hello.SupportedProtos {
+		if proto == acme.ALPNProto {
+			return cert, nil
+		}
+	}
+
+	a.mu.Lock()
+	a.leafs[strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")] = cert.Leaf
+	a.mu.Unlock()
+
+	return cert, nil
+}
+
+// leaf returns the certificate last served for host, or the one in the
+// cache if none has been served yet. It returns nil if host doesn't have a
+// certificate, it is requested on the first handshake.
+func (a *acmeCerts) leaf(host string) *x509.Certificate {
+	a.mu.Lock()
+	leaf := a.leafs[host]
+	a.mu.Unlock()
+
+	if leaf != nil || a.m.Cache == nil {
+		return leaf
+	}
+
+	// the cache stores the private key followed by the certificate chain,
+	// keyed by host for ecdsa and host+rsa for rsa certificates
+	for _, key := range []string{host, host + "+rsa"} {
+		data, err := a.m.Cache.Get(stdcontext.Background(), key)
+		if err != nil {
+			continue
+		}
+
+		for {
+			var block *pem.Block
+			if block, data = pem.Decode(data); block == nil {
+				break
+			}
+
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+
+			if leaf, err = x509.ParseCertificate(block.Bytes); err == nil {
+				return leaf
+			}
+
+			break
+		}
+	}
+
+	return nil
+}
+
+// check returns an error if a certificate of one of the configured hosts is
+// not valid right now
+func (a *acmeCerts) check() error {
+	for _, host := range acmeHosts(configs.current().config) {
+		leaf := a.leaf(host)
+		if leaf == nil {
+			continue
+		}
+
+		if err := checkValidity(leaf); err != nil {
+			return fmt.Errorf("%s: %v", host, err)
+		}
+	}
+
+	return nil
+}
+
+// expiry returns the earliest expiry time of the certificates of the
+// configured hosts
+func (a *acmeCerts) expiry() (time.Time, bool) {
+	var ret time.Time
+
+	for _, host := range acmeHosts(configs.current().config) {
+		leaf := a.leaf(host)
+		if leaf == nil {
+			continue
+		}
+
+		if ret.IsZero() || leaf.NotAfter.Before(ret) {
+			ret = leaf.NotAfter
+		}
+	}
+
+	return ret, !ret.IsZero()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// certLoader serves a tls certificate loaded from disk and swaps it
+// atomically whenever the files change or SIGHUP is received. If a new
+// certificate can't be loaded, the previous one continues to be served.
+type certLoader struct {
+	certFile, keyFile string
+
+	cert    atomic.Value // *tls.Certificate
+	certMod fileVersion
+	keyMod  fileVersion
+}
+
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(name string) (fileVersion, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return fileVersion{}, err
+	}
+	return fileVersion{modTime: fi.ModTime(), size: fi.Size()}, nil
+}
+
+func newCertLoader(certFile, keyFile string) (*certLoader, error) {
+	l := certLoader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+
+	return &l, nil
+}
+
+func (l *certLoader) reload() error {
+	certMod, err := statFile(l.certFile)
+	if err != nil {
+		return err
+	}
+
+	keyMod, err := statFile(l.keyFile)
+	if err != nil {
+		return err
+	}
+
+	// remember the attempted versions even on failure so that a bad pair is
+	// only retried once the files change again
+	l.certMod, l.keyMod = certMod, keyMod
+
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return err
+	}
+
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+
+	l.cert.Store(&cert)
+
+	return nil
+}
+
+// changed reports whether either file differs from the last loaded version
+func (l *certLoader) changed() bool {
+	certMod, err := statFile(l.certFile)
+	if err != nil {
+		return false
+	}
+
+	keyMod, err := statFile(l.keyFile)
+	if err != nil {
+		return false
+	}
+
+	return certMod != l.certMod || keyMod != l.keyMod
+}
+
+// watch reloads the certificate on SIGHUP and, if interval is non-zero,
+// whenever polling detects that the files have changed. It never returns.
+func (l *certLoader) watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	for {
+		select {
+		case <-hup:
+			log.Printf("received SIGHUP, reloading tls certificate")
+		case <-tick:
+			if !l.changed() {
+				continue
+			}
+			log.Printf("tls certificate files changed, reloading")
+		}
+
+		if err := l.reload(); err != nil {
+			log.Printf("error reloading tls certificate, keeping previous: %v", err)
+			continue
+		}
+
+		log.Printf("reloaded tls certificate (%s, %s)", l.certFile, l.keyFile)
+	}
+}
+
+func (l *certLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return l.cert.Load().(*tls.Certificate), nil
+}
+
+// check returns an error if the current certificate is not valid right now
+func (l *certLoader) check() error {
+	return checkValidity(l.cert.Load().(*tls.Certificate).Leaf)
+}
+
+// checkValidity returns an error if leaf is not valid right now
+func checkValidity(leaf *x509.Certificate) error {
+	now := time.Now()
+
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("certificate is not valid before %s", leaf.NotBefore)
+	}
+
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("certificate expired at %s", leaf.NotAfter)
+	}
+
+	return nil
+}
+
+// expiry returns the expiry time of the current certificate
+func (l *certLoader) expiry() (time.Time, bool) {
+	return l.cert.Load().(*tls.Certificate).Leaf.NotAfter, true
+}
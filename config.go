@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Settings are resolved with the following precedence, highest first:
+//
+//  1. command line flags
+//  2. environment variables
+//  3. the config file
+//  4. built in defaults
+//
+// The config file is a yaml, toml or json document, selected by its
+// extension, whose keys are the flag names (e.g. "repo-root"). In addition
+// the "mappings" and "hosts" keys hold the same structures as the mapping
+// file and are merged with those loaded from it.
+const (
+	originFlag    = "flag"
+	originEnv     = "env"
+	originFile    = "file"
+	originDefault = "default"
+)
+
+// redacted replaces secrets in printed configuration
+const redacted = "<redacted>"
+
+var (
+	// cmdlineFlags are the flags set on the command line, recorded before
+	// the config file sets any
+	cmdlineFlags = map[string]bool{}
+
+	// fileFlags are the flags set by the config file
+	fileFlags = map[string]bool{}
+)
+
+// recordCmdlineFlags must be called after flag.Parse and before the config
+// file is applied
+func recordCmdlineFlags() {
+	flag.Visit(func(f *flag.Flag) { cmdlineFlags[f.Name] = true })
+}
+
+// envName returns the environment variable a flag defaults to
+func envName(flagName string) string {
+	return strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// flagOrigin reports where the effective value of a flag came from
+func flagOrigin(name string) string {
+	switch {
+	case cmdlineFlags[name]:
+		return originFlag
+	case len(getDefaultString(envName(name), "")) > 0:
+		return originEnv
+	case fileFlags[name]:
+		return originFile
+	}
+	return originDefault
+}
+
+// readConfigFile parses name into a generic map according to its extension
+func readConfigFile(name string) (map[string]interface{}, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]interface{}{}
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &raw)
+	case ".toml":
+		_, err = toml.Decode(string(b), &raw)
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		err = dec.Decode(&raw)
+	default:
+		return nil, fmt.Errorf("%s: unsupported config file type, must be .yaml, .yml, .toml or .json", name)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %v", name, err)
+	}
+
+	return raw, nil
+}
+
+// applyConfigFile sets the flags named by the keys of the config file unless
+// they were set on the command line or by the environment. It is only called
+// at startup, changes to these settings require a restart.
+func applyConfigFile(name string) error {
+	raw, err := readConfigFile(name)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(raw))
+	for k := range raw {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		// mappings and hosts are loaded with every snapshot
+		if k == "mappings" || k == "hosts" {
+			continue
+		}
+
+		if err = applyConfigValue(k, raw[k]); err != nil {
+			return fmt.Errorf("%s: %s: %v", name, k, err)
+		}
+	}
+
+	return nil
+}
+
+// configFileLists are the parts of the config file that are reloaded along
+// with the mapping file
+type configFileLists struct {
+	Mappings []mapping
+	Hosts    []vhost
+
+	// Allowlist is nil if the allowlist is set by a flag or the environment
+	Allowlist []string
+}
+
+func loadConfigFileLists(name string) (*configFileLists, error) {
+	raw, err := readConfigFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret configFileLists
+
+	if v, ok := raw["mappings"]; ok {
+		if err = decodeStrict(v, &ret.Mappings); err != nil {
+			return nil, fmt.Errorf("%s: mappings: %v", name, err)
+		}
+	}
+
+	if v, ok := raw["hosts"]; ok {
+		if err = decodeStrict(v, &ret.Hosts); err != nil {
+			return nil, fmt.Errorf("%s: hosts: %v", name, err)
+		}
+	}
+
+	if o := flagOrigin("allowlist"); o != originFlag && o != originEnv {
+		ret.Allowlist = []string{}
+
+		if v, ok := raw["allowlist"]; ok {
+			s, err := flagString(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: allowlist: %v", name, err)
+			}
+			ret.Allowlist = append(ret.Allowlist, splitList(s)...)
+		}
+	}
+
+	return &ret, nil
+}
+
+func applyConfigValue(key string, v interface{}) error {
+	if key == "config" || flag.Lookup(key) == nil {
+		return fmt.Errorf("unknown key")
+	}
+
+	if cmdlineFlags[key] || flagOrigin(key) == originEnv {
+		return nil
+	}
+
+	s, err := flagString(v)
+	if err != nil {
+		return err
+	}
+
+	if err = flag.Set(key, s); err != nil {
+		return err
+	}
+
+	fileFlags[key] = true
+	return nil
+}
+
+// flagString formats a config file value as it would be given on the command
+// line, lists become comma separated
+func flagString(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string, bool, int, int64, float64, json.Number:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, e := range v {
+			s, err := flagString(e)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = s
+		}
+		return strings.Join(parts, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", v)
+}
+
+// decodeStrict decodes a generic config file value into v, rejecting unknown
+// fields, by round tripping it through json
+func decodeStrict(in, v interface{}) error {
+	b, err := json.Marshal(jsonValue(in))
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// jsonValue converts the map[interface{}]interface{} values produced by the
+// yaml decoder into map[string]interface{} which can be encoded as json
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonValue(e)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = jsonValue(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = jsonValue(e)
+		}
+		return l
+	case []map[string]interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = jsonValue(e)
+		}
+		return l
+	}
+	return v
+}
+
+// redactHosts returns a copy of hosts with every discovery token replaced by
+// with
+func redactHosts(hosts []vhost, with string) []vhost {
+	if hosts == nil {
+		return nil
+	}
+
+	ret := make([]vhost, len(hosts))
+	for i, h := range hosts {
+		if len(h.DiscoveryToken) > 0 {
+			h.DiscoveryToken = with
+		}
+		ret[i] = h
+	}
+
+	return ret
+}
+
+// withoutSecrets returns c with the discovery tokens cleared so that it can
+// be handed to templates
+func (c config) withoutSecrets() config {
+	c.DiscoveryToken = ""
+	c.Hosts = redactHosts(c.Hosts, "")
+	return c
+}
+
+// printConfig writes the effective configuration to w, annotating every
+// setting with where its value came from
+func printConfig(w io.Writer) error {
+	fmt.Fprintln(w, "# precedence: flag > env > file > default")
+	if len(cfg.ConfigFile) > 0 {
+		fmt.Fprintf(w, "# config file: %s\n", cfg.ConfigFile)
+	}
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == "config" {
+			return
+		}
+
+		origin := flagOrigin(f.Name)
+		if origin == originEnv {
+			origin += " $" + envName(f.Name)
+		}
+
+		value := f.Value.String()
+		if strings.HasSuffix(f.Name, "-token") && len(value) > 0 {
+			value = redacted
+		}
+
+		_, err = fmt.Fprintf(w, "%s = %q # %s\n", f.Name, value, origin)
+	})
+	if err != nil {
+		return err
+	}
+
+	// mappings and hosts are merged from the config file and mapping file
+	// rather than overridden so they are annotated with both
+	var files []string
+	for _, f := range []string{cfg.ConfigFile, cfg.MappingFile} {
+		if len(f) > 0 {
+			files = append(files, f)
+		}
+	}
+
+	origin := originDefault
+	if len(files) > 0 {
+		origin = originFile + " " + strings.Join(files, ", ")
+	}
+
+	for _, s := range []struct {
+		name string
+		v    interface{}
+	}{
+		{"mappings", cfg.Mappings},
+		{"hosts", redactHosts(cfg.Hosts, redacted)},
+	} {
+		// avoid escaping the brackets of redacted values
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(s.v); err != nil {
+			return err
+		}
+
+		b := bytes.TrimSpace(buf.Bytes())
+		if string(b) == "null" {
+			b = []byte("[]")
+		}
+
+		if _, err := fmt.Fprintf(w, "# %s\n%s = %s\n", origin, s.name, b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
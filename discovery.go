@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	discoveryTimeout = 30 * time.Second
+	discoveryGitHub  = "github"
+	discoveryGitLab  = "gitlab"
+	discoveryGitea   = "gitea"
+)
+
+// provider lists the repositories below a repo root on a forge. Each is
+// returned as a mapping whose path is relative to the repo root and that
+// holds the clone url, the browser url and the go-source layout of the forge
+// so that they are served like configured mappings.
+type provider interface {
+	mappings(repoRoot string) ([]mapping, error)
+}
+
+func validDiscovery(kind string) error {
+	switch kind {
+	case "", discoveryGitHub, discoveryGitLab, discoveryGitea:
+		return nil
+	}
+	return fmt.Errorf("discovery must be empty, %q, %q or %q", discoveryGitHub, discoveryGitLab, discoveryGitea)
+}
+
+// discoveryTarget is a repo root and the api its repositories are listed
+// with
+type discoveryTarget struct {
+	kind, url, token, root string
+}
+
+func (t discoveryTarget) provider() provider {
+	url := t.url
+	if len(url) == 0 {
+		url = defaultDiscoveryURL(t.kind, t.root)
+	}
+
+	switch t.kind {
+	case discoveryGitHub:
+		return newGitHub(url, t.token)
+	case discoveryGitLab:
+		return newGitLab(url, t.token)
+	}
+	return newGitea(url, t.token)
+}
+
+// defaultDiscoveryURL returns the public GitHub api for github and the
+// scheme and host of the repo root for self hosted forges
+func defaultDiscoveryURL(kind, root string) string {
+	if kind == discoveryGitHub {
+		return defaultGitHubDiscovery
+	}
+
+	u, err := url.Parse(root)
+	if err != nil {
+		return root
+	}
+
+	return u.Scheme + "://" + u.Host
+}
+
+// discoveryTargets returns the distinct repo roots of c and its hosts that
+// have discovery enabled
+func discoveryTargets(c config) []discoveryTarget {
+	configs := []config{c}
+	for _, h := range c.Hosts {
+		hc, _ := c.forHost(h.Host)
+		configs = append(configs, hc)
+	}
+
+	seen := map[string]bool{}
+	var ret []discoveryTarget
+
+	for _, hc := range configs {
+		root := strings.TrimSuffix(hc.RepoRoot, "/")
+		if len(hc.Discovery) == 0 || len(root) == 0 || seen[root] {
+			continue
+		}
+
+		seen[root] = true
+		ret = append(ret, discoveryTarget{
+			kind:  hc.Discovery,
+			url:   hc.DiscoveryURL,
+			token: hc.DiscoveryToken,
+			root:  root,
+		})
+	}
+
+	return ret
+}
+
+// discoverer periodically lists the repositories below every repo root with
+// discovery enabled and keeps the last successful result of each
+type discoverer struct {
+	mu        sync.Mutex
+	providers map[discoveryTarget]provider
+	results   map[string][]mapping
+	lastErr   error
+}
+
+var discoveries = newDiscoverer()
+
+func newDiscoverer() *discoverer {
+	return &discoverer{
+		providers: map[discoveryTarget]provider{},
+		results:   map[string][]mapping{},
+	}
+}
+
+// refresh lists the repositories of every repo root of the current
+// configuration. Roots that fail keep their previous result. Providers are
+// kept between refreshes so that their ETag caches are reused.
+func (d *discoverer) refresh() {
+	var lastErr error
+
+	for _, t := range discoveryTargets(configs.current().config) {
+		d.mu.Lock()
+		p, ok := d.providers[t]
+		if !ok {
+			p = t.provider()
+			d.providers[t] = p
+		}
+		d.mu.Unlock()
+
+		found, err := p.mappings(t.root)
+		if err == nil {
+			err = validateMappings(found)
+		}
+
+		if err != nil {
+			log.Printf("error discovering repositories of %s, keeping previous: %v", t.root, err)
+			lastErr = err
+			continue
+		}
+
+		sort.Slice(found, func(i, j int) bool { return found[i].Path < found[j].Path })
+
+		d.mu.Lock()
+		d.results[t.root] = found
+		d.mu.Unlock()
+	}
+
+	d.mu.Lock()
+	d.lastErr = lastErr
+	d.mu.Unlock()
+}
+
+// watch refreshes the discovered repositories every interval. It never
+// returns unless interval is not positive, which disables refreshes.
+func (d *discoverer) watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for range t.C {
+		d.refresh()
+	}
+}
+
+// mappings returns the mappings discovered below repoRoot
+func (d *discoverer) mappings(repoRoot string) []mapping {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.results[strings.TrimSuffix(repoRoot, "/")]
+}
+
+// check fails if the last refresh failed for any repo root
+func (d *discoverer) check() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lastErr
+}
+
+// allMappings returns the configured mappings of c followed by those
+// discovered below its repo root, configured ones take precedence over
+// discovered ones with the same path
+func (c config) allMappings() []mapping {
+	if len(c.Discovery) == 0 {
+		return c.Mappings
+	}
+
+	found := discoveries.mappings(c.RepoRoot)
+	ret := make([]mapping, 0, len(c.Mappings)+len(found))
+	return append(append(ret, c.Mappings...), found...)
+}
+
+// apiClient performs GET requests against a forge api, revalidating
+// previously seen responses with their ETag so that unchanged pages don't
+// count against rate limits
+type apiClient struct {
+	header http.Header
+	client http.Client
+
+	mu    sync.Mutex
+	cache map[string]apiResponse
+}
+
+type apiResponse struct {
+	etag string
+	body []byte
+	next string
+}
+
+func newAPIClient(header http.Header) *apiClient {
+	header.Set("User-Agent", "gopkgredir")
+
+	return &apiClient{
+		header: header,
+		client: http.Client{Timeout: discoveryTimeout},
+		cache:  map[string]apiResponse{},
+	}
+}
+
+var linkNextRe = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// get returns the body of u and the url of the next page from the Link
+// header, if any
+func (c *apiClient) get(u string) ([]byte, string, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for k, v := range c.header {
+		req.Header[k] = v
+	}
+
+	c.mu.Lock()
+	cached, ok := c.cache[u]
+	c.mu.Unlock()
+
+	if ok {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode == http.StatusNotModified && ok {
+		return cached.body, cached.next, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", &apiError{url: u, status: resp.StatusCode, body: strings.TrimSpace(string(body))}
+	}
+
+	var next string
+	if m := linkNextRe.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+		next = m[1]
+	}
+
+	if etag := resp.Header.Get("ETag"); len(etag) > 0 {
+		c.mu.Lock()
+		c.cache[u] = apiResponse{etag: etag, body: body, next: next}
+		c.mu.Unlock()
+	}
+
+	return body, next, nil
+}
+
+type apiError struct {
+	url    string
+	status int
+	body   string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s returned %d %s: %s", e.url, e.status, http.StatusText(e.status), e.body)
+}
+
+// ownerPath returns the path of a repo root url without leading and trailing
+// slashes, e.g. "org" for "https://github.com/org"
+func ownerPath(repoRoot string) (string, error) {
+	u, err := url.Parse(repoRoot)
+	if err != nil {
+		return "", err
+	}
+
+	owner := strings.Trim(u.Path, "/")
+	if len(owner) == 0 {
+		return "", fmt.Errorf("repo root %s has no owner path", repoRoot)
+	}
+
+	return owner, nil
+}
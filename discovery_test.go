@@ -0,0 +1,219 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeForge serves api pages by request uri, linking to the next page and
+// answering requests that send the ETag of a page with 304
+type fakeForge struct {
+	pages map[string]fakePage
+
+	mu          sync.Mutex
+	ok          int
+	notModified int
+}
+
+type fakePage struct {
+	body string
+	next string
+}
+
+func (f *fakeForge) handler(base func() string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, ok := f.pages[r.URL.RequestURI()]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		etag := `"` + r.URL.RequestURI() + `"`
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		if r.Header.Get("If-None-Match") == etag {
+			f.notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		f.ok++
+		w.Header().Set("ETag", etag)
+		if len(page.next) > 0 {
+			w.Header().Set("Link", `<`+base()+page.next+`>; rel="next", <`+base()+`/last>; rel="last"`)
+		}
+		_, _ = w.Write([]byte(page.body))
+	})
+}
+
+func (f *fakeForge) counts() (int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ok, notModified := f.ok, f.notModified
+	f.ok, f.notModified = 0, 0
+	return ok, notModified
+}
+
+func TestDiscovery(t *testing.T) {
+	tests := []struct {
+		name  string
+		kind  string
+		root  string
+		pages map[string]fakePage
+		paths []string
+	}{
+		{
+			name: "github pagination",
+			kind: discoveryGitHub,
+			root: "https://github.com/org",
+			pages: map[string]fakePage{
+				"/orgs/org/repos?per_page=100": {
+					body: `[{"name":"a","clone_url":"https://github.com/org/a.git"},{"name":"old","archived":true}]`,
+					next: "/orgs/org/repos?per_page=100&page=2",
+				},
+				"/orgs/org/repos?per_page=100&page=2": {
+					body: `[{"name":"b"},{"name":"../invalid"}]`,
+				},
+			},
+			paths: []string{"a", "b"},
+		},
+		{
+			name: "github user",
+			kind: discoveryGitHub,
+			root: "https://github.com/user",
+			pages: map[string]fakePage{
+				"/users/user/repos?per_page=100": {body: `[{"name":"a"},{"name":"old","archived":true}]`},
+			},
+			paths: []string{"a"},
+		},
+		{
+			name: "gitlab subgroups",
+			kind: discoveryGitLab,
+			root: "https://gitlab.example.com/group",
+			pages: map[string]fakePage{
+				"/api/v4/groups/group/projects?include_subgroups=true&archived=false&per_page=100": {
+					body: `[{"path_with_namespace":"group/a"},{"path_with_namespace":"group/old","archived":true}]`,
+					next: "/api/v4/groups/group/projects?include_subgroups=true&archived=false&per_page=100&page=2",
+				},
+				"/api/v4/groups/group/projects?include_subgroups=true&archived=false&per_page=100&page=2": {
+					body: `[{"path_with_namespace":"group/sub/project"},{"path_with_namespace":"other/b"}]`,
+				},
+			},
+			paths: []string{"a", "sub/project"},
+		},
+		{
+			name: "gitlab subgroup root",
+			kind: discoveryGitLab,
+			root: "https://gitlab.example.com/group/sub",
+			pages: map[string]fakePage{
+				"/api/v4/groups/group%2Fsub/projects?include_subgroups=true&archived=false&per_page=100": {
+					body: `[{"path_with_namespace":"group/sub/project"}]`,
+				},
+			},
+			paths: []string{"project"},
+		},
+		{
+			name: "gitlab user",
+			kind: discoveryGitLab,
+			root: "https://gitlab.example.com/user",
+			pages: map[string]fakePage{
+				"/api/v4/users/user/projects?archived=false&per_page=100": {body: `[{"path_with_namespace":"user/a"}]`},
+			},
+			paths: []string{"a"},
+		},
+		{
+			name: "gitea pagination",
+			kind: discoveryGitea,
+			root: "https://gitea.example.com/org",
+			pages: map[string]fakePage{
+				"/api/v1/orgs/org/repos?limit=50": {
+					body: `[{"name":"a"},{"name":"old","archived":true}]`,
+					next: "/api/v1/orgs/org/repos?limit=50&page=2",
+				},
+				"/api/v1/orgs/org/repos?limit=50&page=2": {body: `[{"name":"b"}]`},
+			},
+			paths: []string{"a", "b"},
+		},
+		{
+			name: "gitea user",
+			kind: discoveryGitea,
+			root: "https://gitea.example.com/user",
+			pages: map[string]fakePage{
+				"/api/v1/users/user/repos?limit=50": {body: `[{"name":"a"}]`},
+			},
+			paths: []string{"a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forge := &fakeForge{pages: tt.pages}
+
+			var srv *httptest.Server
+			srv = httptest.NewServer(forge.handler(func() string { return srv.URL }))
+			defer srv.Close()
+
+			p := discoveryTarget{kind: tt.kind, url: srv.URL, root: tt.root}.provider()
+
+			found, err := p.mappings(tt.root)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if paths := mappingPaths(found); !reflect.DeepEqual(paths, tt.paths) {
+				t.Errorf("paths = %q, want %q", paths, tt.paths)
+			}
+
+			ok, _ := forge.counts()
+			if ok != len(tt.pages) {
+				t.Errorf("fetched %d pages, want %d", ok, len(tt.pages))
+			}
+
+			// unchanged pages are revalidated and served from the cache
+			again, err := p.mappings(tt.root)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(again, found) {
+				t.Errorf("revalidated mappings = %+v, want %+v", again, found)
+			}
+
+			if ok, notModified := forge.counts(); ok != 0 || notModified != len(tt.pages) {
+				t.Errorf("revalidation fetched %d pages and got %d not modified, want 0 and %d", ok, notModified, len(tt.pages))
+			}
+		})
+	}
+}
+
+func mappingPaths(mappings []mapping) []string {
+	var ret []string
+	for _, m := range mappings {
+		ret = append(ret, m.Path)
+	}
+	return ret
+}
+
+func TestDiscoveryWatchDisabled(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Second} {
+		done := make(chan struct{})
+
+		go func() {
+			newDiscoverer().watch(interval)
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Errorf("watch(%s) did not return", interval)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// runExport implements the export command which writes the page of every
+// configured package to a directory tree that can be served by a static web
+// server. Static servers can't tell the go tool and browsers apart so each
+// index.html carries the meta tags and either redirects or renders the
+// landing page depending on the browser mode.
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s export:\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "  %s [flags] export [export flags] <dir>\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "\nExport Flags:\n")
+		fs.PrintDefaults()
+	}
+
+	notFound := fs.Bool("not-found", false, "also write a 404.html for unknown packages")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	dir := fs.Arg(0)
+
+	// without vhosts the tree is written for the import-prefix host directly,
+	// with them every host gets its own subdirectory
+	if len(cfg.Hosts) == 0 {
+		return exportHost(cfg, dir, *notFound)
+	}
+
+	if len(cfg.ImportPrefix) > 0 {
+		if err := exportHost(cfg, filepath.Join(dir, importHost(cfg.ImportPrefix)), *notFound); err != nil {
+			return err
+		}
+	}
+
+	for _, h := range cfg.Hosts {
+		c, _ := cfg.forHost(h.Host)
+		if err := exportHost(c, filepath.Join(dir, h.Host), *notFound); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// exportPaths returns the package paths of c that can be listed without a
+// request to resolve them, those of the repositories, the subpackages of the
+// mappings and the major versions of the mappings that have a rule
+func exportPaths(c config) []string {
+	ret := repoPaths(c)
+
+	for _, m := range c.Mappings {
+		for _, sub := range m.Subpackages {
+			ret = append(ret, m.Path+"/"+sub)
+		}
+
+		for _, mv := range m.Majors {
+			ret = append(ret, m.Path+"/v"+strconv.Itoa(mv.Major))
+		}
+	}
+
+	return ret
+}
+
+func exportHost(c config, dir string, notFound bool) error {
+	if len(c.ImportPrefix) == 0 {
+		return fmt.Errorf("import-prefix is not configured")
+	}
+
+	paths := exportPaths(c)
+	if len(paths) == 0 {
+		return fmt.Errorf("%s: nothing to export, packages must be listed in the mapping file or allowlist", c.ImportPrefix)
+	}
+
+	for _, p := range paths {
+		ctx, ok := newContext(c, p)
+		if !ok {
+			return fmt.Errorf("%s/%s: invalid package", c.ImportPrefix, p)
+		}
+
+		name := redirectTplName
+		if ctx.Browser == browserPage {
+			name = pageTplName
+			ctx.LatestTag = latestTags.get(ctx)
+		}
+
+		if err := exportFile(filepath.Join(dir, filepath.FromSlash(p), "index.html"), name, ctx); err != nil {
+			return err
+		}
+	}
+
+	if c.Index {
+		data := indexData{ImportPrefix: c.ImportPrefix, Packages: indexEntries(c, "")}
+		if err := exportFile(filepath.Join(dir, "index.html"), indexTplName, data); err != nil {
+			return err
+		}
+	}
+
+	if notFound {
+		data := notFoundData{ImportPrefix: c.ImportPrefix}
+
+		if err := exportFile(filepath.Join(dir, "404.html"), notFoundTplName, data); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("exported %d packages of %s to %s", len(paths), c.ImportPrefix, dir)
+	return nil
+}
+
+func exportFile(name, tpl string, data interface{}) error {
+	var buf bytes.Buffer
+	if err := configs.current().html.ExecuteTemplate(&buf, tpl, data); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(name, buf.Bytes(), 0644)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// gitea lists the repositories of the organization or user a repo root such
+// as "https://gitea.example.com/org" points at using the Gitea REST API
+type gitea struct {
+	baseURL string
+	api     *apiClient
+}
+
+type giteaRepo struct {
+	Name          string `json:"name"`
+	Description   string `json:"description"`
+	CloneURL      string `json:"clone_url"`
+	HTMLURL       string `json:"html_url"`
+	DefaultBranch string `json:"default_branch"`
+	Archived      bool   `json:"archived"`
+}
+
+func newGitea(baseURL, token string) *gitea {
+	header := http.Header{}
+
+	if len(token) > 0 {
+		header.Set("Authorization", "token "+token)
+	}
+
+	return &gitea{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		api:     newAPIClient(header),
+	}
+}
+
+func (g *gitea) mappings(repoRoot string) ([]mapping, error) {
+	owner, err := ownerPath(repoRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	ret, err := g.list(g.baseURL + "/api/v1/orgs/" + url.PathEscape(owner) + "/repos?limit=50")
+	if e, ok := err.(*apiError); ok && e.status == http.StatusNotFound {
+		return g.list(g.baseURL + "/api/v1/users/" + url.PathEscape(owner) + "/repos?limit=50")
+	}
+
+	return ret, err
+}
+
+func (g *gitea) list(next string) ([]mapping, error) {
+	var ret []mapping
+
+	for len(next) > 0 {
+		body, n, err := g.api.get(next)
+		if err != nil {
+			return nil, err
+		}
+		next = n
+
+		var page []giteaRepo
+		if err = json.Unmarshal(body, &page); err != nil {
+			return nil, err
+		}
+
+		for _, r := range page {
+			if r.Archived || !validImportPath(r.Name) {
+				continue
+			}
+
+			ret = append(ret, mapping{
+				Path:         r.Name,
+				Description:  r.Description,
+				Repo:         r.CloneURL,
+				Redirect:     r.HTMLURL,
+				Source:       sourceGitea,
+				SourceBranch: r.DefaultBranch,
+			})
+		}
+	}
+
+	return ret, nil
+}
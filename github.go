@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const defaultGitHubDiscovery = "https://api.github.com"
+
+// gitHub lists the repositories of the organization or user a repo root
+// such as "https://github.com/org" points at using the GitHub REST API
+type gitHub struct {
+	baseURL string
+	api     *apiClient
+}
+
+type gitHubRepo struct {
+	Name          string `json:"name"`
+	Description   string `json:"description"`
+	CloneURL      string `json:"clone_url"`
+	HTMLURL       string `json:"html_url"`
+	DefaultBranch string `json:"default_branch"`
+	Archived      bool   `json:"archived"`
+}
+
+func newGitHub(baseURL, token string) *gitHub {
+	header := http.Header{}
+	header.Set("Accept", "application/vnd.github+json")
+
+	if len(token) > 0 {
+		header.Set("Authorization", "token "+token)
+	}
+
+	return &gitHub{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		api:     newAPIClient(header),
+	}
+}
+
+// mappings lists the repositories of the organization, falling back to those
+// of the user if there is no such organization. Archived repositories are
+// left out.
+func (g *gitHub) mappings(repoRoot string) ([]mapping, error) {
+	owner, err := ownerPath(repoRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	ret, err := g.list(g.baseURL + "/orgs/" + url.PathEscape(owner) + "/repos?per_page=100")
+	if e, ok := err.(*apiError); ok && e.status == http.StatusNotFound {
+		return g.list(g.baseURL + "/users/" + url.PathEscape(owner) + "/repos?per_page=100")
+	}
+
+	return ret, err
+}
+
+func (g *gitHub) list(next string) ([]mapping, error) {
+	var ret []mapping
+
+	for len(next) > 0 {
+		body, n, err := g.api.get(next)
+		if err != nil {
+			return nil, err
+		}
+		next = n
+
+		var page []gitHubRepo
+		if err = json.Unmarshal(body, &page); err != nil {
+			return nil, err
+		}
+
+		for _, r := range page {
+			if r.Archived || !validImportPath(r.Name) {
+				continue
+			}
+
+			ret = append(ret, mapping{
+				Path:         r.Name,
+				Description:  r.Description,
+				Repo:         r.CloneURL,
+				Redirect:     r.HTMLURL,
+				Source:       sourceGitHub,
+				SourceBranch: r.DefaultBranch,
+			})
+		}
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// gitLab lists the projects of the group, including those of all its
+// subgroups, or user a repo root such as "https://gitlab.example.com/group"
+// points at using the GitLab REST API. Projects of subgroups are mapped to
+// multi segment paths, e.g. "sub/project" for "group/sub/project".
+type gitLab struct {
+	baseURL string
+	api     *apiClient
+}
+
+type gitLabProject struct {
+	PathWithNamespace string `json:"path_with_namespace"`
+	Description       string `json:"description"`
+	HTTPURLToRepo     string `json:"http_url_to_repo"`
+	WebURL            string `json:"web_url"`
+	DefaultBranch     string `json:"default_branch"`
+	Archived          bool   `json:"archived"`
+}
+
+func newGitLab(baseURL, token string) *gitLab {
+	header := http.Header{}
+
+	if len(token) > 0 {
+		header.Set("PRIVATE-TOKEN", token)
+	}
+
+	return &gitLab{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		api:     newAPIClient(header),
+	}
+}
+
+func (g *gitLab) mappings(repoRoot string) ([]mapping, error) {
+	owner, err := ownerPath(repoRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	ret, err := g.list(owner, g.baseURL+"/api/v4/groups/"+url.PathEscape(owner)+"/projects?include_subgroups=true&archived=false&per_page=100")
+	if e, ok := err.(*apiError); ok && e.status == http.StatusNotFound && !strings.Contains(owner, "/") {
+		return g.list(owner, g.baseURL+"/api/v4/users/"+url.PathEscape(owner)+"/projects?archived=false&per_page=100")
+	}
+
+	return ret, err
+}
+
+func (g *gitLab) list(owner, next string) ([]mapping, error) {
+	var ret []mapping
+
+	for len(next) > 0 {
+		body, n, err := g.api.get(next)
+		if err != nil {
+			return nil, err
+		}
+		next = n
+
+		var page []gitLabProject
+		if err = json.Unmarshal(body, &page); err != nil {
+			return nil, err
+		}
+
+		for _, p := range page {
+			path := strings.TrimPrefix(p.PathWithNamespace, owner+"/")
+			if p.Archived || path == p.PathWithNamespace || !validImportPath(path) {
+				continue
+			}
+
+			ret = append(ret, mapping{
+				Path:         path,
+				Description:  p.Description,
+				Repo:         p.HTTPURLToRepo,
+				Redirect:     p.WebURL,
+				Source:       sourceGitLab,
+				SourceBranch: p.DefaultBranch,
+			})
+		}
+	}
+
+	return ret, nil
+}
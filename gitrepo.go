@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	stdcontext "context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errRevNotFound = errors.New("revision not found")
+
+// gitRepos provides access to git repositories by url. Local repositories
+// are used in place, remote ones are mirrored into cacheDir and fetched at
+// most once per interval.
+type gitRepos struct {
+	cacheDir string
+	interval time.Duration
+
+	mu    sync.Mutex
+	repos map[string]*gitRepo
+}
+
+type gitRepo struct {
+	url   string
+	dir   string
+	local bool
+
+	mu      sync.Mutex
+	fetched time.Time
+}
+
+func newGitRepos(cacheDir string, interval time.Duration) *gitRepos {
+	return &gitRepos{
+		cacheDir: cacheDir,
+		interval: interval,
+		repos:    map[string]*gitRepo{},
+	}
+}
+
+// localRepoPath returns the filesystem path of url if it refers to a local
+// repository
+func localRepoPath(url string) (string, bool) {
+	if strings.HasPrefix(url, "file://") {
+		return strings.TrimPrefix(url, "file://"), true
+	}
+
+	if filepath.IsAbs(url) {
+		return url, true
+	}
+
+	return "", false
+}
+
+// open returns the repository for url, cloning or fetching it as required
+func (g *gitRepos) open(url string) (*gitRepo, error) {
+	g.mu.Lock()
+	r, ok := g.repos[url]
+	if !ok {
+		r = &gitRepo{url: url}
+
+		if dir, local := localRepoPath(url); local {
+			r.dir, r.local = dir, true
+		} else {
+			sum := sha256.Sum256([]byte(url))
+			r.dir = filepath.Join(g.cacheDir, hex.EncodeToString(sum[:]))
+		}
+
+		g.repos[url] = r
+	}
+	g.mu.Unlock()
+
+	if err := r.update(g.interval); err != nil {
+		// forget repositories that were never cloned so that urls that
+		// fail don't accumulate
+		if !r.updated() {
+			g.mu.Lock()
+			if g.repos[url] == r {
+				delete(g.repos, url)
+			}
+			g.mu.Unlock()
+		}
+
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// updated reports whether r was cloned or fetched successfully before
+func (r *gitRepo) updated() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.fetched.IsZero()
+}
+
+func (r *gitRepo) update(interval time.Duration) error {
+	if r.local {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.fetched) < interval {
+		return nil
+	}
+
+	if _, err := os.Stat(r.dir); os.IsNotExist(err) {
+		if err = os.MkdirAll(filepath.Dir(r.dir), 0755); err != nil {
+			return err
+		}
+
+		if _, err = runGit("", "clone", "--mirror", "--quiet", r.url, r.dir); err != nil {
+			return err
+		}
+	} else if _, err = r.git("fetch", "--prune", "--quiet"); err != nil {
+		return err
+	}
+
+	r.fetched = time.Now()
+	return nil
+}
+
+func runGit(dir string, args ...string) ([]byte, error) {
+	return runGitContext(stdcontext.Background(), dir, args...)
+}
+
+func runGitContext(ctx stdcontext.Context, dir string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
+
+func (r *gitRepo) git(args ...string) ([]byte, error) {
+	return runGit(r.dir, args...)
+}
+
+// tags returns the names of the tags starting with prefix, with the prefix
+// removed
+func (r *gitRepo) tags(prefix string) ([]string, error) {
+	out, err := r.git("for-each-ref", "--format=%(refname:strip=2)", "refs/tags/"+prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, prefix) && len(line) > len(prefix) {
+			ret = append(ret, line[len(prefix):])
+		}
+	}
+
+	return ret, nil
+}
+
+// mergedTags is like tags but only returns tags reachable from rev
+func (r *gitRepo) mergedTags(prefix, rev string) ([]string, error) {
+	out, err := r.git("tag", "--list", "--merged", rev, prefix+"*")
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, prefix) && len(line) > len(prefix) {
+			ret = append(ret, line[len(prefix):])
+		}
+	}
+
+	return ret, nil
+}
+
+// commit resolves rev to a full commit hash and its commit time
+func (r *gitRepo) commit(rev string) (string, time.Time, error) {
+	out, err := r.git("log", "-1", "--format=%H %ct", rev+"^{commit}", "--")
+	if err != nil {
+		return "", time.Time{}, errRevNotFound
+	}
+
+	f := strings.Fields(string(out))
+	if len(f) != 2 {
+		return "", time.Time{}, fmt.Errorf("unexpected git log output %q", out)
+	}
+
+	sec, err := strconv.ParseInt(f[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return f[0], time.Unix(sec, 0).UTC(), nil
+}
+
+// exists reports whether path exists in the tree of rev
+func (r *gitRepo) exists(rev, path string) bool {
+	_, err := r.git("cat-file", "-e", rev+":"+path)
+	return err == nil
+}
+
+// readFile returns the contents of path in the tree of rev
+func (r *gitRepo) readFile(rev, path string) ([]byte, error) {
+	if !r.exists(rev, path) {
+		return nil, os.ErrNotExist
+	}
+	return r.git("cat-file", "blob", rev+":"+path)
+}
+
+// archive returns a tar archive of dir in the tree of rev
+func (r *gitRepo) archive(rev, dir string) ([]byte, error) {
+	treeish := rev
+	if len(dir) > 0 {
+		treeish += ":" + dir
+	}
+	return r.git("archive", "--format=tar", treeish)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	sourceNone      = "none"
+	sourceGitHub    = "github"
+	sourceGitLab    = "gitlab"
+	sourceGitea     = "gitea"
+	sourceBitbucket = "bitbucket"
+	sourceHgweb     = "hgweb"
+	sourceFossil    = "fossil"
+)
+
+// sourceLayout holds the go-source url templates for a single forge. In
+// addition to the {dir}, {/dir}, {file} and {line} substitutions performed by
+// the go tooling, {repo} and {branch} are replaced before rendering.
+type sourceLayout struct {
+	Home string
+	Dir  string
+	File string
+}
+
+var sourceLayouts = map[string]sourceLayout{
+	sourceGitHub: {
+		Home: "{repo}",
+		Dir:  "{repo}/tree/{branch}{/dir}",
+		File: "{repo}/blob/{branch}{/dir}/{file}#L{line}",
+	},
+	sourceGitLab: {
+		Home: "{repo}",
+		Dir:  "{repo}/-/tree/{branch}{/dir}",
+		File: "{repo}/-/blob/{branch}{/dir}/{file}#L{line}",
+	},
+	sourceGitea: {
+		Home: "{repo}",
+		Dir:  "{repo}/src/branch/{branch}{/dir}",
+		File: "{repo}/src/branch/{branch}{/dir}/{file}#L{line}",
+	},
+	sourceBitbucket: {
+		Home: "{repo}",
+		Dir:  "{repo}/src/{branch}{/dir}",
+		File: "{repo}/src/{branch}{/dir}/{file}#lines-{line}",
+	},
+	sourceHgweb: {
+		Home: "{repo}",
+		Dir:  "{repo}/file/{branch}{/dir}",
+		File: "{repo}/file/{branch}{/dir}/{file}#l{line}",
+	},
+	sourceFossil: {
+		Home: "{repo}",
+		Dir:  "{repo}/dir?ci={branch}&name={dir}",
+		File: "{repo}/file{/dir}/{file}?ci={branch}&ln={line}",
+	},
+}
+
+// sourceHosts are the well known public git hosts whose layout can be
+// detected from the repo url alone
+var sourceHosts = map[string]string{
+	"github.com":    sourceGitHub,
+	"gitlab.com":    sourceGitLab,
+	"gitea.com":     sourceGitea,
+	"codeberg.org":  sourceGitea,
+	"bitbucket.org": sourceBitbucket,
+}
+
+func validSource(name string) error {
+	if len(name) == 0 || name == sourceNone {
+		return nil
+	}
+
+	if _, ok := sourceLayouts[name]; !ok {
+		return fmt.Errorf("unknown source layout %q", name)
+	}
+
+	return nil
+}
+
+func detectSource(repo string) string {
+	u, err := url.Parse(repo)
+	if err != nil {
+		return sourceNone
+	}
+
+	if s, ok := sourceHosts[strings.ToLower(u.Hostname())]; ok {
+		return s
+	}
+
+	return sourceNone
+}
+
+// goSource returns the go-source urls for repo or nil if no layout applies.
+// Explicitly configured templates in override take precedence over those of
+// the layout.
+func goSource(name, repo, branch string, override sourceLayout) *sourceLayout {
+	if len(name) == 0 {
+		name = detectSource(repo)
+	}
+
+	layout, ok := sourceLayouts[name]
+	if !ok {
+		layout = sourceLayout{}
+	}
+
+	if len(override.Home) > 0 {
+		layout.Home = override.Home
+	}
+
+	if len(override.Dir) > 0 {
+		layout.Dir = override.Dir
+	}
+
+	if len(override.File) > 0 {
+		layout.File = override.File
+	}
+
+	if len(layout.Dir) == 0 || len(layout.File) == 0 {
+		return nil
+	}
+
+	if len(layout.Home) == 0 {
+		layout.Home = "_"
+	}
+
+	r := strings.NewReplacer(
+		"{repo}", strings.TrimSuffix(repo, ".git"),
+		"{branch}", branch,
+	)
+
+	return &sourceLayout{
+		Home: r.Replace(layout.Home),
+		Dir:  r.Replace(layout.Dir),
+		File: r.Replace(layout.File),
+	}
+}
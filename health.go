@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const backendCheckTimeout = 2 * time.Second
+
+// health holds the named checks that must all pass for the server to report
+// itself as ready
+type health struct {
+	mu     sync.Mutex
+	checks map[string]func() error
+}
+
+var readiness = &health{}
+
+func (h *health) add(name string, check func() error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.checks == nil {
+		h.checks = map[string]func() error{}
+	}
+
+	h.checks[name] = check
+}
+
+// run executes all checks in name order, writing a line per check to buf, and
+// reports whether they all passed
+func (h *health) run(buf *bytes.Buffer) bool {
+	h.mu.Lock()
+	names := make([]string, 0, len(h.checks))
+	checks := make(map[string]func() error, len(h.checks))
+	for name, check := range h.checks {
+		names = append(names, name)
+		checks[name] = check
+	}
+	h.mu.Unlock()
+
+	sort.Strings(names)
+
+	ok := true
+	for _, name := range names {
+		if err := checks[name](); err != nil {
+			ok = false
+			fmt.Fprintf(buf, "[-]%s failed: %v\n", name, err)
+			continue
+		}
+		fmt.Fprintf(buf, "[+]%s ok\n", name)
+	}
+
+	return ok
+}
+
+func (h *health) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		status := http.StatusOK
+
+		if !h.run(&buf) {
+			status = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(status)
+		_, _ = buf.WriteTo(w)
+	})
+}
+
+// livenessHandler only reports that the process is able to serve requests
+func livenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		_, _ = fmt.Fprintln(w, "ok")
+	})
+}
+
+func checkConfig() error {
+	c := configs.current().config
+	if len(c.ImportPrefix) == 0 && len(c.Hosts) == 0 {
+		return fmt.Errorf("import-prefix is not configured")
+	}
+	return nil
+}
+
+// backendURLs returns the distinct scheme and host of every repository url
+// that may be served
+func backendURLs() []string {
+	c := configs.current().config
+
+	repos := []string{c.RepoRoot}
+	for _, m := range c.Mappings {
+		repos = append(repos, m.Repo)
+	}
+
+	for _, h := range c.Hosts {
+		repos = append(repos, h.RepoRoot)
+		for _, m := range h.Mappings {
+			repos = append(repos, m.Repo)
+		}
+	}
+
+	seen := map[string]bool{}
+	var ret []string
+
+	for _, repo := range repos {
+		u, err := url.Parse(repo)
+		if err != nil || len(u.Host) == 0 || (u.Scheme != "http" && u.Scheme != "https") {
+			continue
+		}
+
+		b := u.Scheme + "://" + u.Host + "/"
+		if seen[b] {
+			continue
+		}
+
+		seen[b] = true
+		ret = append(ret, b)
+	}
+
+	return ret
+}
+
+func checkBackends() error {
+	client := http.Client{Timeout: backendCheckTimeout}
+
+	for _, b := range backendURLs() {
+		resp, err := client.Head(b)
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("%s returned %s", b, resp.Status)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// indexEntry describes a package listed on the index page
+type indexEntry struct {
+	Path        string `json:"path"`
+	ImportPath  string `json:"import_path"`
+	Description string `json:"description,omitempty"`
+	RepoURL     string `json:"repo_url"`
+	RedirectURL string `json:"redirect_url"`
+	DocURL      string `json:"doc_url,omitempty"`
+	License     string `json:"license,omitempty"`
+	VCS         string `json:"vcs"`
+}
+
+// indexData is the data index.html is executed with
+type indexData struct {
+	// ImportPrefix is the import prefix of the host the request was made to
+	ImportPrefix string
+
+	// Query is the filter given with ?q=, if any
+	Query string
+
+	// Packages are the known packages matching Query sorted by import path
+	Packages []indexEntry
+}
+
+// repoPaths returns the vanity paths of the repositories of c that are known
+// without a request to resolve them, those of the mappings, those in the
+// allowlist and those discovered below repo-root
+func repoPaths(c config) []string {
+	var ret []string
+	seen := map[string]bool{}
+
+	add := func(p string) {
+		if !seen[p] {
+			seen[p] = true
+			ret = append(ret, p)
+		}
+	}
+
+	for _, m := range c.allMappings() {
+		add(m.Path)
+	}
+
+	for _, a := range c.Allowlist {
+		if c.allowed(a) {
+			add(a)
+		}
+	}
+
+	return ret
+}
+
+// description returns the description of the repository at the vanity path p
+// from its mapping or discovery
+func description(c config, p string) string {
+	for _, m := range c.allMappings() {
+		if m.Path == p {
+			return m.Description
+		}
+	}
+
+	return ""
+}
+
+// indexEntries returns the known repositories of c whose import path or
+// description contain query, ignoring case
+func indexEntries(c config, query string) []indexEntry {
+	query = strings.ToLower(query)
+
+	var ret []indexEntry
+	for _, p := range repoPaths(c) {
+		ctx, ok := newContext(c, p)
+		if !ok {
+			continue
+		}
+
+		e := indexEntry{
+			Path:        p,
+			ImportPath:  ctx.ImportPath,
+			Description: description(c, p),
+			RepoURL:     ctx.RepoURL,
+			RedirectURL: ctx.RedirectURL,
+			DocURL:      ctx.DocURL,
+			License:     ctx.License,
+			VCS:         ctx.VCS,
+		}
+
+		if len(query) > 0 &&
+			!strings.Contains(strings.ToLower(e.ImportPath), query) &&
+			!strings.Contains(strings.ToLower(e.Description), query) {
+			continue
+		}
+
+		ret = append(ret, e)
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ImportPath < ret[j].ImportPath })
+	return ret
+}
+
+// serveIndex responds with the index of known packages, as json if the
+// client prefers it over html
+func serveIndex(w http.ResponseWriter, r *http.Request, s *snapshot, c config) {
+	data := indexData{
+		ImportPrefix: c.ImportPrefix,
+		Query:        strings.TrimSpace(r.URL.Query().Get("q")),
+	}
+	data.Packages = indexEntries(c, data.Query)
+
+	w.Header().Set("Vary", "Accept")
+
+	if prefersJSON(r.Header.Get("Accept")) {
+		if data.Packages == nil {
+			data.Packages = []indexEntry{}
+		}
+		writeJSON(w, data.Packages)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if err := s.html.ExecuteTemplate(w, indexTplName, data); err != nil {
+		stats.templateError()
+		log.Println("error executing template", err)
+	}
+}
+
+// prefersJSON reports whether an Accept header ranks application/json higher
+// than text/html
+func prefersJSON(accept string) bool {
+	var jsonQ, htmlQ float64
+
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+
+		switch mt {
+		case "application/json":
+			jsonQ = maxFloat(jsonQ, q)
+		case "text/html", "text/*", "*/*":
+			htmlQ = maxFloat(htmlQ, q)
+		}
+	}
+
+	return jsonQ > 0 && jsonQ > htmlQ
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
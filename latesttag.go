@@ -0,0 +1,159 @@
+package main
+
+import (
+	stdcontext "context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	latestTagTimeout = 5 * time.Second
+
+	// latestTagEntries bounds the number of repositories whose latest tag is
+	// cached
+	latestTagEntries = 1024
+)
+
+// tagCache remembers the latest tag of remote git repositories for landing
+// pages. Failed lookups are cached too so that an unreachable repository is
+// not queried on every request, and concurrent requests for a repository
+// share a single lookup.
+type tagCache struct {
+	mu      sync.Mutex
+	entries map[string]tagEntry
+	pending map[string]*tagLookup
+}
+
+type tagEntry struct {
+	tag     string
+	fetched time.Time
+}
+
+// tagLookup is a lookup in progress, done is closed once tag is set
+type tagLookup struct {
+	done chan struct{}
+	tag  string
+}
+
+var latestTags = &tagCache{}
+
+// get returns the latest tag of the repository of ctx, or an empty string if
+// it is neither a git repository nor has a companion one, is not mapped,
+// discovered or allowlisted, the lookup is disabled or it failed
+func (c *tagCache) get(ctx context) string {
+	if (ctx.VCS != vcsGit && len(ctx.CompanionURL) == 0) || !ctx.Listed || ctx.LatestTagTTL <= 0 {
+		return ""
+	}
+
+	url := ctx.CloneURL
+
+	c.mu.Lock()
+
+	if e, ok := c.entries[url]; ok && time.Since(e.fetched) < ctx.LatestTagTTL {
+		c.mu.Unlock()
+		return e.tag
+	}
+
+	if l, ok := c.pending[url]; ok {
+		c.mu.Unlock()
+		<-l.done
+		return l.tag
+	}
+
+	if c.pending == nil {
+		c.pending = map[string]*tagLookup{}
+	}
+
+	l := &tagLookup{done: make(chan struct{})}
+	c.pending[url] = l
+	c.mu.Unlock()
+
+	tag, err := lsRemoteLatest(url)
+	if err != nil {
+		log.Printf("error looking up latest tag of %s: %v", url, err)
+	}
+
+	l.tag = tag
+	close(l.done)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.pending, url)
+	c.add(url, tagEntry{tag: tag, fetched: time.Now()}, ctx.LatestTagTTL)
+	return tag
+}
+
+// add caches e for url. Once the cache is full, expired entries are dropped
+// to make room, or the oldest one if none has expired. c.mu must be held.
+func (c *tagCache) add(url string, e tagEntry, ttl time.Duration) {
+	if c.entries == nil {
+		c.entries = map[string]tagEntry{}
+	}
+
+	if _, ok := c.entries[url]; !ok && len(c.entries) >= latestTagEntries {
+		var oldest string
+		for u, old := range c.entries {
+			if time.Since(old.fetched) >= ttl {
+				delete(c.entries, u)
+				continue
+			}
+
+			if len(oldest) == 0 || old.fetched.Before(c.entries[oldest].fetched) {
+				oldest = u
+			}
+		}
+
+		if len(c.entries) >= latestTagEntries {
+			delete(c.entries, oldest)
+		}
+	}
+
+	c.entries[url] = e
+}
+
+// lsRemoteLatest returns the highest release tag of the repository at url,
+// or the highest pre-release if there are no releases
+func lsRemoteLatest(url string) (string, error) {
+	ctx, cancel := stdcontext.WithTimeout(stdcontext.Background(), latestTagTimeout)
+	defer cancel()
+
+	out, err := runGitContext(ctx, "", "ls-remote", "--tags", "--refs", url)
+	if err != nil {
+		return "", err
+	}
+
+	var release, pre *semver
+	for _, line := range strings.Split(string(out), "\n") {
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			continue
+		}
+
+		v, ok := parseSemver(strings.TrimPrefix(f[1], "refs/tags/"))
+		if !ok || v.isPseudo() {
+			continue
+		}
+
+		latest := &release
+		if len(v.pre) > 0 {
+			latest = &pre
+		}
+
+		if *latest == nil || v.compare(**latest) > 0 {
+			v := v
+			*latest = &v
+		}
+	}
+
+	switch {
+	case release != nil:
+		return release.String(), nil
+	case pre != nil:
+		return pre.String(), nil
+	}
+
+	return "", nil
+}
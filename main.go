@@ -1,49 +1,224 @@
 package main // import "zvelo.io/gopkgredir"
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
 )
 
-const tpl = `<!DOCTYPE html>
+// metaTpl renders the meta tags required by the go tool
+const metaTpl = `{{define "` + metaTplName + `"}}
+<meta name="go-import" content="{{.ImportPrefix}}/{{.RepoName}} {{.VCS}} {{.RepoURL}}">
+{{- with .CompanionURL}}
+<meta name="go-import" content="{{$.ImportPrefix}}/{{$.RepoName}} git {{.}}">
+{{- end}}
+{{- with .Source}}
+<meta name="go-source" content="{{$.ImportPrefix}}/{{$.SourceRoot}} {{.Home}} {{.Dir}} {{.File}}">
+{{- end}}
+{{- end}}`
+
+// goGetTpl is served in response to ?go-get=1 requests
+const goGetTpl = `<!DOCTYPE html>
+<html>
+<head>
+<meta http-equiv="Content-Type" content="text/html; charset=utf-8"/>
+{{- template "` + metaTplName + `" .}}
+</head>
+</html>
+`
+
+// pageTpl is served to browsers when the browser mode is "page"
+const pageTpl = `<!DOCTYPE html>
 <html>
 <head>
 <meta http-equiv="Content-Type" content="text/html; charset=utf-8"/>
-<meta name="go-import" content="{{.ImportPrefix}}/{{.RepoName}} {{.VCS}} {{.RepoRoot}}/{{.RepoName}}" >
-<meta http-equiv="refresh" content="0; url={{.RedirectRoot}}/{{.RepoName}}">
+<meta name="viewport" content="width=device-width, initial-scale=1"/>
+{{- template "` + metaTplName + `" .}}
+<title>{{.ImportPath}}</title>
 </head>
 <body>
-Nothing to see here; <a href="{{.RedirectRoot}}/{{.RepoName}}">move along</a>.
+<h1>{{.ImportPath}}</h1>
+<pre>go get {{.ImportPath}}</pre>
+<p>Commands can be installed with</p>
+<pre>go install {{.ImportPath}}@latest</pre>
+<ul>
+<li>Source: <a href="{{.RedirectURL}}">{{.RedirectURL}}</a></li>
+{{- with .DocURL}}
+<li>Documentation: <a href="{{.}}">{{.}}</a></li>
+{{- end}}
+{{- with .License}}
+<li>License: {{.}}</li>
+{{- end}}
+{{- with .LatestTag}}
+<li>Latest version: {{.}}</li>
+{{- end}}
+</ul>
+</body>
+</html>
+`
+
+// indexTpl is served to browsers requesting the root path
+const indexTpl = `<!DOCTYPE html>
+<html>
+<head>
+<meta http-equiv="Content-Type" content="text/html; charset=utf-8"/>
+<meta name="viewport" content="width=device-width, initial-scale=1"/>
+<title>{{.ImportPrefix}}</title>
+</head>
+<body>
+<h1>{{.ImportPrefix}}</h1>
+<form method="get" action="/">
+<input type="search" name="q" value="{{.Query}}" placeholder="Filter packages"/>
+<input type="submit" value="Filter"/>
+</form>
+{{- if .Packages}}
+<ul>
+{{- range .Packages}}
+<li><a href="/{{.Path}}">{{.ImportPath}}</a>{{with .Description}} - {{.}}{{end}}</li>
+{{- end}}
+</ul>
+{{- else}}
+<p>No packages{{with .Query}} matching {{.}}{{end}}.</p>
+{{- end}}
+</body>
+</html>
+`
+
+// redirectTpl is written by export for packages whose browser mode is
+// "redirect". Static hosts serve the same file to the go tool and browsers so
+// browsers are redirected with a meta refresh.
+const redirectTpl = `<!DOCTYPE html>
+<html>
+<head>
+<meta http-equiv="Content-Type" content="text/html; charset=utf-8"/>
+{{- template "` + metaTplName + `" .}}
+<meta http-equiv="refresh" content="0; url={{.RedirectURL}}"/>
+</head>
+<body>
+<a href="{{.RedirectURL}}">{{.RedirectURL}}</a>
+</body>
+</html>
+`
+
+// notFoundTpl is served to browsers for unknown or invalid packages
+const notFoundTpl = `<!DOCTYPE html>
+<html>
+<head>
+<meta http-equiv="Content-Type" content="text/html; charset=utf-8"/>
+<meta name="viewport" content="width=device-width, initial-scale=1"/>
+<meta name="robots" content="noindex"/>
+<title>Not Found</title>
+</head>
+<body>
+<h1>Not Found</h1>
+<p>{{if .Path}}There is no package at {{.ImportPrefix}}/{{.Path}}.{{else}}There is no such package on {{.ImportPrefix}}.{{end}}</p>
 </body>
 </html>
 `
 
 const (
-	htmlTplName             = "html"
+	metaTplName             = "meta"
+	goGetTplName            = "go-get"
+	pageTplName             = "page"
+	redirectTplName         = "redirect"
+	indexTplName            = "index"
+	notFoundTplName         = "404"
+	browserRedirect         = "redirect"
+	browserPage             = "page"
 	defaultListenAddress    = "[::1]:http"
 	defaultTLSListenAddress = "[::1]:https"
 )
 
 type config struct {
+	ConfigFile    string
+	ConfigReload  time.Duration
 	ImportPrefix  string
 	VCS           string
 	RepoRoot      string
 	RedirectRoot  string
+	DocRoot       string
+	LatestTagTTL  time.Duration
 	ListenAddress string
 	TLSCertFile   string
 	TLSKeyFile    string
+	TLSReload     time.Duration
+	MappingFile   string
+	TemplatesDir  string
+	Mappings      []mapping
+	Source        string
+	SourceBranch  string
+	Hosts         []vhost
+	UnknownHost   string
+	Browser       string
+	Index         bool
+	Allowlist     []string
+
+	Discovery         string
+	DiscoveryURL      string
+	DiscoveryToken    string
+	DiscoveryInterval time.Duration
+
+	ACME             bool
+	ACMEDirectoryURL string
+	ACMECacheDir     string
+	ACMEEmail        string
+	ACMECAFile       string
+
+	HTTPListenAddress string
+	HTTPRedirect      bool
+	HTTPGoGet         bool
+
+	LivenessPath      string
+	ReadinessPath     string
+	ReadinessBackends bool
+
+	MetricsPath          string
+	MetricsListenAddress string
+
+	AccessLogFormat string
+	AccessLogLevel  string
+	AccessLogFile   string
+	TrustedProxies  string
+
+	ShutdownDelay   time.Duration
+	ShutdownTimeout time.Duration
+
+	Proxy              bool
+	ProxyRepoRoot      string
+	ProxyCacheDir      string
+	ProxyFetchInterval time.Duration
 }
 
 type context struct {
 	config
 	RepoName     string
-	RedirectRoot string
+	Subpackage   string
+	Listed       bool
+	SourceRoot   string
+	MajorBranch  string
+	VCS          string
+	RepoURL      string
+	RedirectURL  string
+	CloneURL     string
+	CompanionURL string
+	Browser      string
+	Source       *sourceLayout
+	ImportPath   string
+	DocURL       string
+	License      string
+	LatestTag    string
 }
 
 var (
@@ -51,8 +226,9 @@ var (
 	gitCommit string
 	buildDate string
 
-	html *template.Template
-	cfg  config
+	cfg       config
+	allowlist string
+	accessLog *accessLogger
 )
 
 func init() {
@@ -60,11 +236,25 @@ func init() {
 		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
 		fmt.Fprintf(flag.CommandLine.Output(), "\nAvailable Commands:\n")
 		fmt.Fprintf(flag.CommandLine.Output(), "  version\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  export [-not-found] <dir>\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  config print\n")
 		fmt.Fprintf(flag.CommandLine.Output(), "\nFlags:\n")
 		flag.PrintDefaults()
 	}
 
-	html = template.Must(template.New(htmlTplName).Parse(tpl))
+	flag.StringVar(
+		&cfg.ConfigFile,
+		"config",
+		getDefaultString("CONFIG_FILE", ""),
+		"yaml, toml or json file whose keys are flag names, plus mappings and hosts as in the mapping file, flags and environment variables take precedence over it [$CONFIG_FILE]",
+	)
+
+	flag.DurationVar(
+		&cfg.ConfigReload,
+		"config-reload-interval",
+		getDefaultDuration("CONFIG_RELOAD_INTERVAL", time.Minute),
+		"how often to check the config and mapping files and templates for changes, 0 disables polling (SIGHUP always reloads) [$CONFIG_RELOAD_INTERVAL]",
+	)
 
 	flag.StringVar(
 		&cfg.ImportPrefix,
@@ -76,8 +266,8 @@ func init() {
 	flag.StringVar(
 		&cfg.VCS,
 		"vcs",
-		getDefaultString("VCS", "git"),
-		"vcs repo type [$VCS]",
+		getDefaultString("VCS", vcsGit),
+		"vcs repo type (git, hg, svn, bzr, fossil or mod), mod serves all packages from the module proxy at repo-root [$VCS]",
 	)
 
 	flag.StringVar(
@@ -94,11 +284,25 @@ func init() {
 		"url to redirect browsers to, if empty, redirects to repo-root/package [$REDIRECT_ROOT]",
 	)
 
+	flag.StringVar(
+		&cfg.DocRoot,
+		"doc-root",
+		getDefaultString("DOC_ROOT", "https://pkg.go.dev"),
+		"url of the documentation site linked from landing pages, the import path is appended, empty disables the link [$DOC_ROOT]",
+	)
+
+	flag.DurationVar(
+		&cfg.LatestTagTTL,
+		"latest-tag-ttl",
+		getDefaultDuration("LATEST_TAG_TTL", 15*time.Minute),
+		"how long the latest tag of a git repository shown on landing pages is cached, 0 disables the lookup [$LATEST_TAG_TTL]",
+	)
+
 	flag.StringVar(
 		&cfg.ListenAddress,
 		"listen-address",
 		getDefaultString("LISTEN_ADDRESS", ""),
-		"address (ip/hostname and port) that the server should listen on (defaults to "+defaultListenAddress+" or "+defaultTLSListenAddress+" if tls certs are defined) [$LISTEN_ADDRESS]",
+		"address (ip/hostname and port) that the server should listen on (defaults to "+defaultListenAddress+" or "+defaultTLSListenAddress+" if tls certs or acme are configured) [$LISTEN_ADDRESS]",
 	)
 
 	flag.StringVar(
@@ -114,6 +318,258 @@ func init() {
 		getDefaultString("TLS_KEY_FILE", ""),
 		"tls key file [$TLS_KEY_FILE]",
 	)
+
+	flag.DurationVar(
+		&cfg.TLSReload,
+		"tls-reload-interval",
+		getDefaultDuration("TLS_RELOAD_INTERVAL", time.Minute),
+		"how often to check the tls certificate and key files for changes, 0 disables polling (SIGHUP always reloads) [$TLS_RELOAD_INTERVAL]",
+	)
+
+	flag.StringVar(
+		&cfg.MappingFile,
+		"mapping-file",
+		getDefaultString("MAPPING_FILE", ""),
+		"json file mapping individual packages to their own repo, vcs and redirect urls, and hosts to their own import prefix, packages not listed fall back to repo-root [$MAPPING_FILE]",
+	)
+
+	flag.StringVar(
+		&cfg.TemplatesDir,
+		"templates-dir",
+		getDefaultString("TEMPLATES_DIR", ""),
+		"directory of html templates (go-get.html, page.html, 404.html, index.html, redirect.html, meta.html) replacing the built in ones, missing files fall back to the built in template, reloaded like the mapping file [$TEMPLATES_DIR]",
+	)
+
+	flag.StringVar(
+		&cfg.Source,
+		"source",
+		getDefaultString("SOURCE", ""),
+		"go-source url layout (github, gitlab, gitea, bitbucket, hgweb, fossil or none), if empty, hgweb for hg, fossil for fossil, none for svn, bzr and mod and detected from the repo url for git [$SOURCE]",
+	)
+
+	flag.StringVar(
+		&cfg.SourceBranch,
+		"source-branch",
+		getDefaultString("SOURCE_BRANCH", ""),
+		"branch used in go-source urls, if empty, master for git, default for hg and trunk for svn, bzr and fossil [$SOURCE_BRANCH]",
+	)
+
+	flag.StringVar(
+		&allowlist,
+		"allowlist",
+		getDefaultString("ALLOWLIST", ""),
+		"comma separated packages that may be served from repo-root, if empty, any valid package is except well known files such as favicon.ico and robots.txt, mapped packages are always served [$ALLOWLIST]",
+	)
+
+	flag.StringVar(
+		&cfg.Browser,
+		"browser",
+		getDefaultString("BROWSER", browserRedirect),
+		"how to respond to browsers, \""+browserRedirect+"\" redirects them to the redirect url, \""+browserPage+"\" renders a landing page [$BROWSER]",
+	)
+
+	flag.BoolVar(
+		&cfg.Index,
+		"index",
+		getDefaultBool("INDEX", true),
+		"serve an index of the mapped and allowlisted packages at / to browsers, as json if requested with \"Accept: application/json\" [$INDEX]",
+	)
+
+	flag.StringVar(
+		&cfg.Discovery,
+		"discovery",
+		getDefaultString("DISCOVERY", ""),
+		"api used to discover the repositories below repo-root (\""+discoveryGitHub+"\", \""+discoveryGitLab+"\" or \""+discoveryGitea+"\"), gitlab subgroups are included, discovered repositories extend the allowlist and are listed on the index, empty disables discovery [$DISCOVERY]",
+	)
+
+	flag.StringVar(
+		&cfg.DiscoveryURL,
+		"discovery-url",
+		getDefaultString("DISCOVERY_URL", ""),
+		"base url of the discovery api, defaults to "+defaultGitHubDiscovery+" for github and the scheme and host of repo-root otherwise [$DISCOVERY_URL]",
+	)
+
+	flag.StringVar(
+		&cfg.DiscoveryToken,
+		"discovery-token",
+		getDefaultString("DISCOVERY_TOKEN", ""),
+		"token used to authenticate to the discovery api [$DISCOVERY_TOKEN]",
+	)
+
+	flag.DurationVar(
+		&cfg.DiscoveryInterval,
+		"discovery-interval",
+		getDefaultDuration("DISCOVERY_INTERVAL", 10*time.Minute),
+		"how often to list the repositories below repo-root, 0 lists them only at startup [$DISCOVERY_INTERVAL]",
+	)
+
+	flag.StringVar(
+		&cfg.UnknownHost,
+		"unknown-host",
+		getDefaultString("UNKNOWN_HOST", unknownHostDefault),
+		"how to handle requests for hosts not listed in the mapping file, \""+unknownHostDefault+"\" serves them with the global settings, \""+unknownHostNotFound+"\" rejects them [$UNKNOWN_HOST]",
+	)
+
+	flag.BoolVar(
+		&cfg.ACME,
+		"acme",
+		getDefaultBool("ACME", false),
+		"obtain and renew tls certificates for the import-prefix host automatically via acme [$ACME]",
+	)
+
+	flag.StringVar(
+		&cfg.ACMEDirectoryURL,
+		"acme-directory-url",
+		getDefaultString("ACME_DIRECTORY_URL", autocert.DefaultACMEDirectory),
+		"acme directory url [$ACME_DIRECTORY_URL]",
+	)
+
+	flag.StringVar(
+		&cfg.ACMECacheDir,
+		"acme-cache-dir",
+		getDefaultString("ACME_CACHE_DIR", ""),
+		"directory used to cache acme account keys and certificates [$ACME_CACHE_DIR]",
+	)
+
+	flag.StringVar(
+		&cfg.ACMEEmail,
+		"acme-email",
+		getDefaultString("ACME_EMAIL", ""),
+		"contact email registered with the acme account [$ACME_EMAIL]",
+	)
+
+	flag.StringVar(
+		&cfg.ACMECAFile,
+		"acme-ca-file",
+		getDefaultString("ACME_CA_FILE", ""),
+		"pem encoded ca bundle used to verify the acme directory, e.g. for a local pebble instance [$ACME_CA_FILE]",
+	)
+
+	flag.StringVar(
+		&cfg.HTTPListenAddress,
+		"http-listen-address",
+		getDefaultString("HTTP_LISTEN_ADDRESS", ""),
+		"address for an additional plain http listener when tls is configured, also answers acme http-01 challenges [$HTTP_LISTEN_ADDRESS]",
+	)
+
+	flag.BoolVar(
+		&cfg.HTTPRedirect,
+		"http-redirect",
+		getDefaultBool("HTTP_REDIRECT", true),
+		"redirect requests on http-listen-address to https [$HTTP_REDIRECT]",
+	)
+
+	flag.BoolVar(
+		&cfg.HTTPGoGet,
+		"http-go-get",
+		getDefaultBool("HTTP_GO_GET", true),
+		"answer ?go-get=1 requests on http-listen-address instead of redirecting them [$HTTP_GO_GET]",
+	)
+
+	flag.StringVar(
+		&cfg.LivenessPath,
+		"liveness-path",
+		getDefaultString("LIVENESS_PATH", "/healthz"),
+		"path reserved for the liveness probe, empty disables it [$LIVENESS_PATH]",
+	)
+
+	flag.StringVar(
+		&cfg.ReadinessPath,
+		"readiness-path",
+		getDefaultString("READINESS_PATH", "/readyz"),
+		"path reserved for the readiness probe, empty disables it [$READINESS_PATH]",
+	)
+
+	flag.BoolVar(
+		&cfg.ReadinessBackends,
+		"readiness-backends",
+		getDefaultBool("READINESS_BACKENDS", false),
+		"include reachability of the repo hosts in the readiness probe [$READINESS_BACKENDS]",
+	)
+
+	flag.StringVar(
+		&cfg.MetricsPath,
+		"metrics-path",
+		getDefaultString("METRICS_PATH", "/metrics"),
+		"path reserved for prometheus metrics, empty disables them [$METRICS_PATH]",
+	)
+
+	flag.StringVar(
+		&cfg.MetricsListenAddress,
+		"metrics-listen-address",
+		getDefaultString("METRICS_LISTEN_ADDRESS", ""),
+		"separate address to serve metrics on, if empty, metrics are served with everything else [$METRICS_LISTEN_ADDRESS]",
+	)
+
+	flag.StringVar(
+		&cfg.AccessLogFormat,
+		"access-log-format",
+		getDefaultString("ACCESS_LOG_FORMAT", accessLogLogfmt),
+		"access log format (logfmt, json or none) [$ACCESS_LOG_FORMAT]",
+	)
+
+	flag.StringVar(
+		&cfg.AccessLogLevel,
+		"access-log-level",
+		getDefaultString("ACCESS_LOG_LEVEL", "info"),
+		"minimum level of requests to log (info, warn for 4xx or error for 5xx) [$ACCESS_LOG_LEVEL]",
+	)
+
+	flag.StringVar(
+		&cfg.AccessLogFile,
+		"access-log-file",
+		getDefaultString("ACCESS_LOG_FILE", ""),
+		"file to write the access log to, reopened on SIGUSR1, if empty, logs to stderr [$ACCESS_LOG_FILE]",
+	)
+
+	flag.StringVar(
+		&cfg.TrustedProxies,
+		"trusted-proxies",
+		getDefaultString("TRUSTED_PROXIES", ""),
+		"comma separated ips or cidrs of proxies whose X-Forwarded-For header is trusted [$TRUSTED_PROXIES]",
+	)
+
+	flag.DurationVar(
+		&cfg.ShutdownDelay,
+		"shutdown-delay",
+		getDefaultDuration("SHUTDOWN_DELAY", 5*time.Second),
+		"how long to keep serving with failing readiness after SIGTERM before closing listeners [$SHUTDOWN_DELAY]",
+	)
+
+	flag.DurationVar(
+		&cfg.ShutdownTimeout,
+		"shutdown-timeout",
+		getDefaultDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+		"maximum time to wait for in-flight requests to complete during shutdown [$SHUTDOWN_TIMEOUT]",
+	)
+
+	flag.BoolVar(
+		&cfg.Proxy,
+		"proxy",
+		getDefaultBool("PROXY", false),
+		"serve the GOPROXY protocol (/@v/list, /@v/<version>.info, .mod, .zip and /@latest) for the mapped, discovered and allowlisted git repositories [$PROXY]",
+	)
+
+	flag.StringVar(
+		&cfg.ProxyRepoRoot,
+		"proxy-repo-root",
+		getDefaultString("PROXY_REPO_ROOT", ""),
+		"base url or local directory the module proxy clones repositories from, the repo name is appended, if empty, repo-root is used [$PROXY_REPO_ROOT]",
+	)
+
+	flag.StringVar(
+		&cfg.ProxyCacheDir,
+		"proxy-cache-dir",
+		getDefaultString("PROXY_CACHE_DIR", ""),
+		"directory remote repositories are mirrored into for the module proxy, if empty, a directory in the system temp dir is used [$PROXY_CACHE_DIR]",
+	)
+
+	flag.DurationVar(
+		&cfg.ProxyFetchInterval,
+		"proxy-fetch-interval",
+		getDefaultDuration("PROXY_FETCH_INTERVAL", time.Minute),
+		"minimum time between fetches of a mirrored repository [$PROXY_FETCH_INTERVAL]",
+	)
 }
 
 func getDefaultString(envVar, fallback string) string {
@@ -124,16 +580,183 @@ func getDefaultString(envVar, fallback string) string {
 	return ret
 }
 
+func getDefaultDuration(envVar string, fallback time.Duration) time.Duration {
+	ret, err := time.ParseDuration(os.Getenv(envVar))
+	if err != nil {
+		return fallback
+	}
+	return ret
+}
+
+func getDefaultBool(envVar string, fallback bool) bool {
+	ret, err := strconv.ParseBool(os.Getenv(envVar))
+	if err != nil {
+		return fallback
+	}
+	return ret
+}
+
 func main() {
 	flag.Parse()
+	recordCmdlineFlags()
 
 	if len(flag.Args()) > 0 && flag.Args()[0] == "version" {
 		fmt.Printf("%s (commit %s; built %s; %s)\n", version, gitCommit, buildDate, runtime.Version())
 		os.Exit(0)
 	}
 
+	// config print needs the loaded configuration, other config subcommands
+	// are rejected before it is loaded
+	if len(flag.Args()) > 0 && flag.Args()[0] == "config" && (len(flag.Args()) != 2 || flag.Args()[1] != "print") {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s config:\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s [flags] config print\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	if len(cfg.ConfigFile) > 0 {
+		if err := applyConfigFile(cfg.ConfigFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := setupConfig(); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(flag.Args()) > 0 && flag.Args()[0] == "config" {
+		if err := printConfig(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	if err := setupDiscovery(); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(flag.Args()) > 0 && flag.Args()[0] == "export" {
+		if err := runExport(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	if err := setupAccessLog(); err != nil {
+		log.Fatal(err)
+	}
+
+	setupProxy()
+	setupReadiness()
 	setupListenAddress()
-	log.Fatal(serve())
+
+	if err := serve(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func validBrowser(mode string) error {
+	if mode != browserRedirect && mode != browserPage {
+		return fmt.Errorf("browser mode must be %q or %q", browserRedirect, browserPage)
+	}
+	return nil
+}
+
+// setupConfig validates the settings that are only read at startup and loads
+// the first snapshot of the reloadable ones
+func setupConfig() error {
+	if err := validVCS(cfg.VCS); err != nil {
+		return err
+	}
+
+	if cfg.VCS == vcsMod && len(cfg.RepoRoot) > 0 {
+		if err := validProxyURL(cfg.RepoRoot); err != nil {
+			return err
+		}
+	}
+
+	if err := validSource(cfg.Source); err != nil {
+		return err
+	}
+
+	if err := validBrowser(cfg.Browser); err != nil {
+		return err
+	}
+
+	if cfg.UnknownHost != unknownHostDefault && cfg.UnknownHost != unknownHostNotFound {
+		return fmt.Errorf("unknown-host must be %q or %q", unknownHostDefault, unknownHostNotFound)
+	}
+
+	l, err := newConfigLoader(cfg)
+	if err != nil {
+		return err
+	}
+
+	configs = l
+	cfg = l.current().config
+
+	if len(l.files()) > 0 {
+		log.Printf("loaded %d mappings and %d hosts from %s", len(cfg.Mappings), len(cfg.Hosts), strings.Join(l.files(), ", "))
+	}
+
+	return nil
+}
+
+func setupAccessLog() error {
+	if cfg.AccessLogFormat == accessLogNone {
+		return nil
+	}
+
+	l, err := newAccessLogger(cfg.AccessLogFormat, cfg.AccessLogLevel, cfg.AccessLogFile, cfg.TrustedProxies)
+	if err != nil {
+		return err
+	}
+
+	accessLog = l
+	return nil
+}
+
+func setupProxy() {
+	if !cfg.Proxy {
+		return
+	}
+
+	if len(cfg.ProxyCacheDir) == 0 {
+		cfg.ProxyCacheDir = filepath.Join(os.TempDir(), "gopkgredir")
+	}
+
+	modProxy = newModuleProxy(cfg.ProxyCacheDir, cfg.ProxyFetchInterval)
+	log.Printf("serving module proxy (cache %s)", cfg.ProxyCacheDir)
+}
+
+// setupDiscovery lists the repositories once so that they are known before
+// the first request is served or the site is exported
+func setupDiscovery() error {
+	if err := validDiscovery(cfg.Discovery); err != nil {
+		return err
+	}
+
+	targets := discoveryTargets(configs.current().config)
+	if len(targets) == 0 {
+		return nil
+	}
+
+	discoveries.refresh()
+
+	for _, t := range targets {
+		log.Printf("discovering %s repositories below %s every %s", t.kind, t.root, cfg.DiscoveryInterval)
+	}
+
+	return nil
+}
+
+func setupReadiness() {
+	readiness.add("config", checkConfig)
+
+	readiness.add("discovery", discoveries.check)
+
+	if cfg.ReadinessBackends {
+		readiness.add("backends", checkBackends)
+	}
 }
 
 func setupListenAddress() {
@@ -141,7 +764,7 @@ func setupListenAddress() {
 		return
 	}
 
-	if len(cfg.TLSCertFile) > 0 && len(cfg.TLSKeyFile) > 0 {
+	if cfg.ACME || (len(cfg.TLSCertFile) > 0 && len(cfg.TLSKeyFile) > 0) {
 		cfg.ListenAddress = defaultTLSListenAddress
 		return
 	}
@@ -150,36 +773,398 @@ func setupListenAddress() {
 }
 
 func serve() error {
+	tlsConfig, acmeManager, err := setupTLS()
+	if err != nil {
+		return err
+	}
+
+	go configs.watch(cfg.ConfigReload)
+
+	// discovery may be enabled for a host by a reload
+	if cfg.DiscoveryInterval > 0 {
+		go discoveries.watch(cfg.DiscoveryInterval)
+	}
+
+	srvs := newServers()
+
+	if len(cfg.MetricsListenAddress) > 0 {
+		mux := http.NewServeMux()
+		mux.Handle(cfg.MetricsPath, stats.handler())
+
+		log.Printf("listening for metrics at %s", cfg.MetricsListenAddress)
+		srvs.start(&http.Server{
+			Addr:    cfg.MetricsListenAddress,
+			Handler: mux,
+		})
+	}
+
+	if tlsConfig == nil {
+		if len(cfg.HTTPListenAddress) > 0 {
+			log.Printf("WARNING: ignoring http-listen-address, TLS has not been configured")
+		}
+
+		log.Printf("WARNING: TLS has not been configured!")
+		log.Printf("listening for http at %s", cfg.ListenAddress)
+		srvs.start(&http.Server{
+			Addr:    cfg.ListenAddress,
+			Handler: handler(false),
+		})
+
+		return srvs.wait(cfg.ShutdownDelay, cfg.ShutdownTimeout)
+	}
+
+	if len(cfg.HTTPListenAddress) > 0 {
+		h := handler(true)
+
+		if acmeManager != nil {
+			h = acmeManager.HTTPHandler(h)
+		}
+
+		log.Printf("listening for http at %s", cfg.HTTPListenAddress)
+		srvs.start(&http.Server{
+			Addr:    cfg.HTTPListenAddress,
+			Handler: h,
+		})
+	}
+
+	srvs.start(&http.Server{
+		Addr:      cfg.ListenAddress,
+		Handler:   handler(false),
+		TLSConfig: tlsConfig,
+	})
+
+	return srvs.wait(cfg.ShutdownDelay, cfg.ShutdownTimeout)
+}
+
+// setupTLS returns the tls config for the configured certificate source, or
+// nil if tls is not configured. The acme manager is only returned when acme is
+// enabled so that http-01 challenges can be answered on the http listener.
+func setupTLS() (*tls.Config, *autocert.Manager, error) {
+	if cfg.ACME {
+		m, err := acmeManager()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		certs := newACMECerts(m)
+		readiness.add("tls", certs.check)
+		stats.setCertExpiry(certs.expiry)
+
+		tlsConfig := m.TLSConfig()
+		tlsConfig.GetCertificate = certs.GetCertificate
+
+		log.Printf("listening for tls at %s (acme %s, hosts %s)", cfg.ListenAddress, cfg.ACMEDirectoryURL, strings.Join(acmeHosts(cfg), ", "))
+		return tlsConfig, m, nil
+	}
+
 	if len(cfg.TLSCertFile) > 0 && len(cfg.TLSKeyFile) > 0 {
+		certs, err := newCertLoader(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		go certs.watch(cfg.TLSReload)
+		readiness.add("tls", certs.check)
+		stats.setCertExpiry(certs.expiry)
+
 		log.Printf("listening for tls at %s (%s, %s)", cfg.ListenAddress, cfg.TLSCertFile, cfg.TLSKeyFile)
-		return http.ListenAndServeTLS(cfg.ListenAddress, cfg.TLSCertFile, cfg.TLSKeyFile, handler())
+		return &tls.Config{GetCertificate: certs.GetCertificate}, nil, nil
 	}
 
-	log.Printf("WARNING: TLS has not been configured!")
-	log.Printf("listening for http at %s", cfg.ListenAddress)
-	return http.ListenAndServe(cfg.ListenAddress, handler())
+	return nil, nil, nil
+}
+
+// shouldUpgrade reports whether a request on the plain http listener should
+// be redirected to https. Requests from the go tool are served over http when
+// http-go-get is set so that they don't depend on tls.
+func shouldUpgrade(r *http.Request) bool {
+	return cfg.HTTPRedirect && !(cfg.HTTPGoGet && r.URL.Query().Get("go-get") == "1")
 }
 
-func handler() http.Handler {
+// httpsPort returns the port of the tls listener, or an empty string if it is
+// the default https port
+func httpsPort() string {
+	_, port, err := net.SplitHostPort(cfg.ListenAddress)
+	if err != nil {
+		return ""
+	}
+
+	if n, err := net.LookupPort("tcp", port); err == nil {
+		if n == 443 {
+			return ""
+		}
+		port = strconv.Itoa(n)
+	}
+
+	return port
+}
+
+// upgradeHandler redirects requests to the same host and path on the tls
+// listener
+func upgradeHandler() http.Handler {
+	port := httpsPort()
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := context{
-			config:       cfg,
-			RedirectRoot: cfg.RedirectRoot,
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
 		}
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
 
-		pkg := strings.Split(r.URL.Path, "/")
-		if len(pkg) > 1 {
-			ctx.RepoName = pkg[1]
+		switch {
+		case len(port) > 0:
+			host = net.JoinHostPort(host, port)
+		case strings.Contains(host, ":"):
+			host = "[" + host + "]"
+		}
+
+		u := *r.URL
+		u.Scheme = "https"
+		u.Host = host
+
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+	})
+}
+
+// handler returns the handler for the package listeners, upgrade is set for
+// the plain http listener when tls is configured
+func handler(upgrade bool) http.Handler {
+	pkg := instrument(packageHandler())
+	up := instrument(upgradeHandler())
+	live := livenessHandler()
+	ready := readiness.handler()
+	metrics := stats.handler()
+
+	var mod http.Handler
+	if modProxy != nil {
+		mod = instrument(modProxy.handler())
+	}
+
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case upgrade && shouldUpgrade(r):
+			up.ServeHTTP(w, r)
+		case len(cfg.LivenessPath) > 0 && r.URL.Path == cfg.LivenessPath:
+			live.ServeHTTP(w, r)
+		case len(cfg.ReadinessPath) > 0 && r.URL.Path == cfg.ReadinessPath:
+			ready.ServeHTTP(w, r)
+		case len(cfg.MetricsListenAddress) == 0 && len(cfg.MetricsPath) > 0 && r.URL.Path == cfg.MetricsPath:
+			metrics.ServeHTTP(w, r)
+		case mod != nil && isProxyPath(r.URL.Path):
+			mod.ServeHTTP(w, r)
+		default:
+			pkg.ServeHTTP(w, r)
+		}
+	})
+
+	if accessLog != nil {
+		h = accessLog.handler(h)
+	}
+
+	return h
+}
+
+func packageHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := configs.current()
+
+		c, ok := s.config.forHost(r.Host)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
 
-			if len(cfg.RedirectRoot) == 0 {
-				ctx.RedirectRoot = ctx.RepoRoot + "/" + pkg[1]
+		if c.Index && len(strings.Trim(r.URL.Path, "/")) == 0 && r.URL.Query().Get("go-get") != "1" {
+			serveIndex(w, r, s, c)
+			return
+		}
+
+		ctx, ok := newContext(c, r.URL.Path)
+		if !ok {
+			notFound(w, r, s.html, c)
+			return
+		}
+
+		setRepo(w, ctx.RepoName)
+
+		name := goGetTplName
+		if r.URL.Query().Get("go-get") != "1" {
+			if ctx.Browser != browserPage {
+				http.Redirect(w, r, ctx.RedirectURL, http.StatusFound)
+				return
 			}
+			name = pageTplName
+			ctx.LatestTag = latestTags.get(ctx)
 		}
 
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 
-		if err := html.ExecuteTemplate(w, htmlTplName, ctx); err != nil {
+		if err := s.html.ExecuteTemplate(w, name, ctx); err != nil {
+			stats.templateError()
 			log.Println("error executing template", err)
 		}
 	})
 }
+
+// notFound responds to requests for unknown or invalid packages. The go tool
+// prints text/plain response bodies so it gets a short explanation, browsers
+// get the not found page.
+func notFound(w http.ResponseWriter, r *http.Request, html *template.Template, c config) {
+	path := strings.Trim(r.URL.Path, "/")
+
+	if r.URL.Query().Get("go-get") == "1" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "%s/%s: unknown package\n", c.ImportPrefix, path)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+
+	data := notFoundData{ImportPrefix: c.ImportPrefix, Path: path}
+
+	if err := html.ExecuteTemplate(w, notFoundTplName, data); err != nil {
+		stats.templateError()
+		log.Println("error executing template", err)
+	}
+}
+
+// newContext resolves path to the repository serving it. ok is false if path
+// is not a valid import path or no repository is known for it.
+func newContext(c config, path string) (ctx context, ok bool) {
+	path = strings.Trim(path, "/")
+	if !validImportPath(path) {
+		return ctx, false
+	}
+
+	ctx = context{
+		config:  c.withoutSecrets(),
+		VCS:     c.VCS,
+		Browser: c.Browser,
+	}
+
+	source, branch := c.Source, c.SourceBranch
+	var override sourceLayout
+
+	if m, subpkg, ok := matchMapping(c.allMappings(), path); ok {
+		ctx.RepoName = m.Path
+		ctx.Subpackage = subpkg
+		ctx.Listed = true
+		ctx.RepoURL = m.Repo
+		ctx.RedirectURL = m.Redirect
+		ctx.CloneURL = m.Clone
+		ctx.CompanionURL = m.Companion
+		ctx.License = m.License
+
+		if len(m.VCS) > 0 {
+			ctx.VCS = m.VCS
+		}
+
+		if len(m.Browser) > 0 {
+			ctx.Browser = m.Browser
+		}
+
+		if len(m.Source) > 0 {
+			source = m.Source
+		}
+
+		if len(m.SourceBranch) > 0 {
+			branch = m.SourceBranch
+		}
+
+		if mv, rest, ok := m.majorVersion(subpkg); ok {
+			major := strings.SplitN(subpkg, "/", 2)[0]
+
+			switch {
+			case len(mv.Repo) > 0:
+				// a separate repository is its own go-import root
+				ctx.RepoName = m.Path + "/" + major
+				ctx.Subpackage = rest
+				ctx.RepoURL = mv.Repo
+				ctx.RedirectURL = mv.Repo
+				ctx.CloneURL = ""
+			case len(mv.Branch) > 0:
+				// the go-import root stays the repository but the code
+				// of the major version is at the root of its branch
+				ctx.SourceRoot = m.Path + "/" + major
+			}
+
+			if len(mv.Branch) > 0 {
+				ctx.MajorBranch = mv.Branch
+				branch = mv.Branch
+			}
+		}
+
+		override = sourceLayout{
+			Home: m.SourceHome,
+			Dir:  m.SourceDir,
+			File: m.SourceFile,
+		}
+	} else {
+		pkg := strings.SplitN(path, "/", 2)
+		if !c.allowed(pkg[0]) {
+			return ctx, false
+		}
+
+		ctx.RepoName = pkg[0]
+		ctx.Listed = len(c.Allowlist) > 0
+
+		if len(pkg) > 1 {
+			ctx.Subpackage = pkg[1]
+		}
+
+		ctx.RepoURL = vcsRepoURL(ctx.VCS, c.RepoRoot, ctx.RepoName)
+
+		if len(c.ProxyRepoRoot) > 0 {
+			ctx.CloneURL = c.ProxyRepoRoot + "/" + ctx.RepoName
+		}
+	}
+
+	// with a companion git repository the go-source urls, browser redirects
+	// and latest tag are those of the git repository rather than of the
+	// module proxy
+	browseURL, conv := ctx.RepoURL, vcsConventions[ctx.VCS]
+	if len(ctx.CompanionURL) > 0 {
+		browseURL, conv = ctx.CompanionURL, vcsConventions[vcsGit]
+	}
+
+	if len(ctx.CloneURL) == 0 {
+		ctx.CloneURL = browseURL
+	}
+
+	if len(ctx.SourceRoot) == 0 {
+		ctx.SourceRoot = ctx.RepoName
+	}
+
+	if len(source) == 0 {
+		source = conv.Source
+	}
+
+	if len(branch) == 0 {
+		branch = conv.Branch
+	}
+
+	ctx.Source = goSource(source, browseURL, branch, override)
+
+	ctx.ImportPath = c.ImportPrefix + "/" + ctx.RepoName
+	if len(ctx.Subpackage) > 0 {
+		ctx.ImportPath += "/" + ctx.Subpackage
+	}
+
+	if len(c.DocRoot) > 0 {
+		ctx.DocURL = strings.TrimSuffix(c.DocRoot, "/") + "/" + ctx.ImportPath
+	}
+
+	if len(ctx.RedirectURL) > 0 {
+		return ctx, true
+	}
+
+	if len(c.RedirectRoot) > 0 {
+		ctx.RedirectURL = c.RedirectRoot + "/" + ctx.RepoName
+		return ctx, true
+	}
+
+	ctx.RedirectURL = browseURL
+	return ctx, true
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUpgradeHandler(t *testing.T) {
+	defer func(addr string) { cfg.ListenAddress = addr }(cfg.ListenAddress)
+
+	tests := []struct {
+		name   string
+		listen string
+		host   string
+		want   string
+	}{
+		{name: "default port", listen: ":443", host: "example.com", want: "https://example.com/foo?go-get=0"},
+		{name: "named default port", listen: "[::1]:https", host: "example.com:80", want: "https://example.com/foo?go-get=0"},
+		{name: "custom port", listen: ":8443", host: "example.com:8080", want: "https://example.com:8443/foo?go-get=0"},
+		{name: "ipv6", listen: ":443", host: "[::1]:8080", want: "https://[::1]/foo?go-get=0"},
+		{name: "ipv6 custom port", listen: "[::1]:8443", host: "[::1]", want: "https://[::1]:8443/foo?go-get=0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.ListenAddress = tt.listen
+
+			r := httptest.NewRequest("GET", "/foo?go-get=0", nil)
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+
+			upgradeHandler().ServeHTTP(w, r)
+
+			if w.Code != http.StatusMovedPermanently {
+				t.Errorf("code = %d, want %d", w.Code, http.StatusMovedPermanently)
+			}
+
+			if loc := w.Header().Get("Location"); loc != tt.want {
+				t.Errorf("Location = %q, want %q", loc, tt.want)
+			}
+		})
+	}
+}
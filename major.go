@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// majorVersion describes where a major version of the module of a mapping is
+// developed. Modules with a major version of 2 or higher are imported with a
+// /vN suffix, e.g. "example.com/foo/v2", and live in one of three layouts:
+//
+//	subdirectory  the "vN" directory of the repository, on its default branch
+//	branch        the repository root on a major version branch
+//	repository    the root of a separate repository
+//
+// Without a rule, or with one that sets neither Repo nor Branch, the
+// subdirectory layout is assumed. The go tool finds modules on major version
+// branches by their tags, the rule makes go-source urls and the module proxy
+// use the branch as well.
+type majorVersion struct {
+	// Major is the major version, at least 2
+	Major int `json:"major"`
+
+	// Repo is the url of a separate repository holding this major version,
+	// it gets its own go-import tag for the path with the /vN suffix
+	Repo string `json:"repo,omitempty"`
+
+	// Branch is the major version branch this major version is developed on
+	Branch string `json:"branch,omitempty"`
+}
+
+func validateMajors(majors []majorVersion) error {
+	seen := map[int]bool{}
+	for _, mv := range majors {
+		if mv.Major < 2 {
+			return fmt.Errorf("major version %d: must be at least 2", mv.Major)
+		}
+
+		if seen[mv.Major] {
+			return fmt.Errorf("major version %d: duplicate major version", mv.Major)
+		}
+		seen[mv.Major] = true
+	}
+
+	return nil
+}
+
+// majorVersion returns the rule of m for the major version suffix subpkg
+// starts with, if any, and the path within the major version that follows it
+func (m mapping) majorVersion(subpkg string) (mv majorVersion, rest string, ok bool) {
+	parts := strings.SplitN(subpkg, "/", 2)
+
+	suffix := majorSuffix(parts[0])
+	if len(suffix) == 0 {
+		return mv, "", false
+	}
+
+	n, _ := strconv.Atoi(suffix[1:])
+
+	if len(parts) > 1 {
+		rest = parts[1]
+	}
+
+	for _, mv = range m.Majors {
+		if mv.Major == n {
+			return mv, rest, true
+		}
+	}
+
+	return majorVersion{}, "", false
+}
@@ -0,0 +1,171 @@
+package main
+
+import "testing"
+
+func TestNewContextMajorVersion(t *testing.T) {
+	c := config{
+		ImportPrefix: "example.com",
+		VCS:          vcsGit,
+		RepoRoot:     "https://github.com/org",
+		RedirectRoot: "https://github.com/org",
+		Source:       sourceGitHub,
+		Mappings: []mapping{
+			{
+				Path:   "sub",
+				Repo:   "https://github.com/org/sub",
+				Majors: []majorVersion{{Major: 2}},
+			},
+			{
+				Path:   "br",
+				Repo:   "https://github.com/org/br",
+				Majors: []majorVersion{{Major: 2, Branch: "v2"}},
+			},
+			{
+				Path:   "sep",
+				Repo:   "https://github.com/org/sep",
+				Majors: []majorVersion{{Major: 2, Repo: "https://github.com/org/sep-v2"}},
+			},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		path        string
+		root        string
+		subpkg      string
+		repoURL     string
+		sourceRoot  string
+		sourceDir   string
+		majorBranch string
+		redirectURL string
+	}{
+		{
+			name:        "major subdirectory",
+			path:        "sub/v2/pkg",
+			root:        "example.com/sub",
+			subpkg:      "v2/pkg",
+			repoURL:     "https://github.com/org/sub",
+			sourceRoot:  "sub",
+			sourceDir:   "https://github.com/org/sub/tree/master{/dir}",
+			redirectURL: "https://github.com/org/sub",
+		},
+		{
+			name:        "major branch",
+			path:        "br/v2/pkg",
+			root:        "example.com/br",
+			subpkg:      "v2/pkg",
+			repoURL:     "https://github.com/org/br",
+			sourceRoot:  "br/v2",
+			sourceDir:   "https://github.com/org/br/tree/v2{/dir}",
+			majorBranch: "v2",
+			redirectURL: "https://github.com/org/br",
+		},
+		{
+			name:        "separate repository",
+			path:        "sep/v2/pkg",
+			root:        "example.com/sep/v2",
+			subpkg:      "pkg",
+			repoURL:     "https://github.com/org/sep-v2",
+			sourceRoot:  "sep/v2",
+			sourceDir:   "https://github.com/org/sep-v2/tree/master{/dir}",
+			redirectURL: "https://github.com/org/sep-v2",
+		},
+		{
+			name:        "separate repository root",
+			path:        "sep/v2",
+			root:        "example.com/sep/v2",
+			repoURL:     "https://github.com/org/sep-v2",
+			sourceRoot:  "sep/v2",
+			sourceDir:   "https://github.com/org/sep-v2/tree/master{/dir}",
+			redirectURL: "https://github.com/org/sep-v2",
+		},
+		{
+			name:        "no rule",
+			path:        "sep/pkg",
+			root:        "example.com/sep",
+			subpkg:      "pkg",
+			repoURL:     "https://github.com/org/sep",
+			sourceRoot:  "sep",
+			sourceDir:   "https://github.com/org/sep/tree/master{/dir}",
+			redirectURL: "https://github.com/org/sep",
+		},
+		{
+			name:        "major version without rule",
+			path:        "sep/v3/pkg",
+			root:        "example.com/sep",
+			subpkg:      "v3/pkg",
+			repoURL:     "https://github.com/org/sep",
+			sourceRoot:  "sep",
+			sourceDir:   "https://github.com/org/sep/tree/master{/dir}",
+			redirectURL: "https://github.com/org/sep",
+		},
+		{
+			name:        "repo-root major version",
+			path:        "foo/v2",
+			root:        "example.com/foo",
+			subpkg:      "v2",
+			repoURL:     "https://github.com/org/foo",
+			sourceRoot:  "foo",
+			sourceDir:   "https://github.com/org/foo/tree/master{/dir}",
+			redirectURL: "https://github.com/org/foo",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, ok := newContext(c, tt.path)
+			if !ok {
+				t.Fatalf("newContext(%q) ok = false", tt.path)
+			}
+
+			if root := ctx.ImportPrefix + "/" + ctx.RepoName; root != tt.root {
+				t.Errorf("go-import root = %q, want %q", root, tt.root)
+			}
+
+			if ctx.Subpackage != tt.subpkg {
+				t.Errorf("Subpackage = %q, want %q", ctx.Subpackage, tt.subpkg)
+			}
+
+			if ctx.RepoURL != tt.repoURL {
+				t.Errorf("RepoURL = %q, want %q", ctx.RepoURL, tt.repoURL)
+			}
+
+			if ctx.SourceRoot != tt.sourceRoot {
+				t.Errorf("SourceRoot = %q, want %q", ctx.SourceRoot, tt.sourceRoot)
+			}
+
+			if ctx.Source == nil || ctx.Source.Dir != tt.sourceDir {
+				t.Errorf("Source = %+v, want Dir %q", ctx.Source, tt.sourceDir)
+			}
+
+			if ctx.MajorBranch != tt.majorBranch {
+				t.Errorf("MajorBranch = %q, want %q", ctx.MajorBranch, tt.majorBranch)
+			}
+
+			if ctx.RedirectURL != tt.redirectURL {
+				t.Errorf("RedirectURL = %q, want %q", ctx.RedirectURL, tt.redirectURL)
+			}
+		})
+	}
+}
+
+func TestValidateMajors(t *testing.T) {
+	tests := []struct {
+		name   string
+		majors []majorVersion
+		ok     bool
+	}{
+		{name: "empty", ok: true},
+		{name: "valid", majors: []majorVersion{{Major: 2}, {Major: 3, Branch: "v3"}}, ok: true},
+		{name: "too low", majors: []majorVersion{{Major: 1}}},
+		{name: "duplicate", majors: []majorVersion{{Major: 2}, {Major: 2, Branch: "v2"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateMajors(tt.majors); (err == nil) != tt.ok {
+				t.Errorf("validateMajors() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// mapping describes where the repository behind a single vanity path is
+// hosted. Any field left empty falls back to the global configuration.
+type mapping struct {
+	// Path is the vanity path relative to the import prefix (e.g. "foo" for
+	// "example.com/foo"), it may span multiple segments (e.g.
+	// "team/backend/service") in which case it takes precedence over any
+	// shorter matching path
+	Path string `json:"path"`
+
+	// Description is shown on the index page
+	Description string `json:"description,omitempty"`
+
+	// Repo is the full url of the repository (e.g. "https://github.com/org/foo")
+	Repo string `json:"repo"`
+
+	// Subpackages lists paths of packages within the repository, relative
+	// to Path, that the export command writes pages for in addition to Path
+	// itself
+	Subpackages []string `json:"subpackages,omitempty"`
+
+	// VCS is the repository type, defaults to the global vcs. With "mod"
+	// Repo is the url of the module proxy serving the module.
+	VCS string `json:"vcs,omitempty"`
+
+	// Companion is the url of a git repository announced in a second
+	// go-import tag next to the mod one for tools and browsers that don't go
+	// through the module proxy. It is used for go-source urls and browser
+	// redirects and is only valid with VCS set to "mod".
+	Companion string `json:"companion,omitempty"`
+
+	// Majors are the rules for where the major versions of the module,
+	// imported with a /vN suffix, are developed
+	Majors []majorVersion `json:"majors,omitempty"`
+
+	// Clone is the url or local path of the git repository the module proxy
+	// builds module zips from, defaults to Repo
+	Clone string `json:"clone,omitempty"`
+
+	// Redirect is the url browsers are sent to, defaults to Repo
+	Redirect string `json:"redirect,omitempty"`
+
+	// Browser is how browsers are responded to ("redirect" or "page"),
+	// defaults to the global browser mode
+	Browser string `json:"browser,omitempty"`
+
+	// License is shown on the landing page, e.g. an SPDX identifier such as
+	// "MIT"
+	License string `json:"license,omitempty"`
+
+	// Source is the go-source url layout (github, gitlab, gitea, bitbucket,
+	// hgweb, fossil or none), defaults to the global layout or that of the
+	// vcs, git layouts are detected from Repo
+	Source string `json:"source,omitempty"`
+
+	// SourceBranch is the branch used in go-source urls, defaults to the
+	// global source branch or the default branch of the vcs
+	SourceBranch string `json:"source_branch,omitempty"`
+
+	// SourceHome, SourceDir and SourceFile override the go-source url
+	// templates of the layout
+	SourceHome string `json:"source_home,omitempty"`
+	SourceDir  string `json:"source_dir,omitempty"`
+	SourceFile string `json:"source_file,omitempty"`
+}
+
+type mappingFile struct {
+	Mappings []mapping `json:"mappings"`
+	Allow    []string  `json:"allow,omitempty"`
+	Hosts    []vhost   `json:"hosts,omitempty"`
+}
+
+func loadMappingFile(name string) (*mappingFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+
+	var mf mappingFile
+	if err = dec.Decode(&mf); err != nil {
+		return nil, fmt.Errorf("error parsing mapping file %s: %v", name, err)
+	}
+
+	if err = validateMappings(mf.Mappings); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	if err = validateHosts(mf.Hosts); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	return &mf, nil
+}
+
+// validateMappings normalizes and validates mappings in place
+func validateMappings(mappings []mapping) error {
+	seen := map[string]bool{}
+	for i, m := range mappings {
+		m.Path = strings.Trim(m.Path, "/")
+
+		if len(m.Path) == 0 {
+			return fmt.Errorf("mapping %d: path is required", i)
+		}
+
+		if !validImportPath(m.Path) {
+			return fmt.Errorf("mapping %q: invalid path", m.Path)
+		}
+
+		if len(m.Repo) == 0 {
+			return fmt.Errorf("mapping %q: repo is required", m.Path)
+		}
+
+		for j, sub := range m.Subpackages {
+			sub = strings.Trim(sub, "/")
+			if !validImportPath(sub) {
+				return fmt.Errorf("mapping %q: invalid subpackage %q", m.Path, sub)
+			}
+			m.Subpackages[j] = sub
+		}
+
+		if len(m.VCS) > 0 {
+			if err := validVCS(m.VCS); err != nil {
+				return fmt.Errorf("mapping %q: %v", m.Path, err)
+			}
+		}
+
+		if m.VCS == vcsMod {
+			if err := validProxyURL(m.Repo); err != nil {
+				return fmt.Errorf("mapping %q: %v", m.Path, err)
+			}
+		}
+
+		if err := validateMajors(m.Majors); err != nil {
+			return fmt.Errorf("mapping %q: %v", m.Path, err)
+		}
+
+		if len(m.Companion) > 0 && m.VCS != vcsMod {
+			return fmt.Errorf("mapping %q: companion requires vcs %q", m.Path, vcsMod)
+		}
+
+		if err := validSource(m.Source); err != nil {
+			return fmt.Errorf("mapping %q: %v", m.Path, err)
+		}
+
+		if len(m.Browser) > 0 {
+			if err := validBrowser(m.Browser); err != nil {
+				return fmt.Errorf("mapping %q: %v", m.Path, err)
+			}
+		}
+
+		if seen[m.Path] {
+			return fmt.Errorf("mapping %q: duplicate path", m.Path)
+		}
+		seen[m.Path] = true
+
+		mappings[i] = m
+	}
+
+	return nil
+}
+
+// matchMapping finds the mapping with the longest path that is a prefix of
+// name on segment boundaries. The remaining segments of name, if any, are the
+// subpackage path within the matched repository.
+func matchMapping(mappings []mapping, name string) (m mapping, subpkg string, ok bool) {
+	name = strings.Trim(name, "/")
+
+	for _, c := range mappings {
+		if len(c.Path) <= len(m.Path) {
+			continue
+		}
+
+		if name == c.Path {
+			m, subpkg, ok = c, "", true
+			continue
+		}
+
+		if strings.HasPrefix(name, c.Path+"/") {
+			m, subpkg, ok = c, name[len(c.Path)+1:], true
+		}
+	}
+
+	return m, subpkg, ok
+}
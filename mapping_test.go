@@ -0,0 +1,116 @@
+package main
+
+import "testing"
+
+func TestMatchMapping(t *testing.T) {
+	mappings := []mapping{
+		{Path: "foo", Repo: "https://github.com/org/foo"},
+		{Path: "team", Repo: "https://gitlab.com/team"},
+		{Path: "team/backend/service", Repo: "https://gitlab.com/team/backend/service"},
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		repo   string
+		subpkg string
+		ok     bool
+	}{
+		{name: "exact", path: "foo", repo: "foo", ok: true},
+		{name: "subpackage", path: "foo/bar/baz", repo: "foo", subpkg: "bar/baz", ok: true},
+		{name: "longest prefix", path: "team/backend/service/pkg", repo: "team/backend/service", subpkg: "pkg", ok: true},
+		{name: "longest prefix exact", path: "team/backend/service", repo: "team/backend/service", ok: true},
+		{name: "shorter prefix", path: "team/backend/other", repo: "team", subpkg: "backend/other", ok: true},
+		{name: "partial segment", path: "foobar", ok: false},
+		{name: "partial segment of longer", path: "team/backend/services", repo: "team", subpkg: "backend/services", ok: true},
+		{name: "slashes", path: "/foo/bar/", repo: "foo", subpkg: "bar", ok: true},
+		{name: "no match", path: "other", ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, subpkg, ok := matchMapping(mappings, tt.path)
+			if ok != tt.ok {
+				t.Fatalf("matchMapping(%q) ok = %v, want %v", tt.path, ok, tt.ok)
+			}
+
+			if !ok {
+				return
+			}
+
+			if m.Path != tt.repo || subpkg != tt.subpkg {
+				t.Errorf("matchMapping(%q) = %q, %q, want %q, %q", tt.path, m.Path, subpkg, tt.repo, tt.subpkg)
+			}
+		})
+	}
+}
+
+func TestNewContextMapping(t *testing.T) {
+	c := config{
+		ImportPrefix: "example.com",
+		VCS:          vcsGit,
+		RepoRoot:     "https://github.com/org",
+		Mappings: []mapping{
+			{Path: "team/backend/service", Repo: "https://gitlab.com/team/backend/service"},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		repo    string
+		subpkg  string
+		repoURL string
+		ok      bool
+	}{
+		{
+			name:    "mapped",
+			path:    "/team/backend/service/pkg",
+			repo:    "team/backend/service",
+			subpkg:  "pkg",
+			repoURL: "https://gitlab.com/team/backend/service",
+			ok:      true,
+		},
+		{
+			name:    "repo-root fallback",
+			path:    "/foo/bar",
+			repo:    "foo",
+			subpkg:  "bar",
+			repoURL: "https://github.com/org/foo",
+			ok:      true,
+		},
+		{
+			name:    "repo-root fallback below mapping prefix",
+			path:    "/team/backend",
+			repo:    "team",
+			subpkg:  "backend",
+			repoURL: "https://github.com/org/team",
+			ok:      true,
+		},
+		{name: "invalid", path: "/../etc", ok: false},
+		{name: "empty", path: "/", ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, ok := newContext(c, tt.path)
+			if ok != tt.ok {
+				t.Fatalf("newContext(%q) ok = %v, want %v", tt.path, ok, tt.ok)
+			}
+
+			if !ok {
+				return
+			}
+
+			if ctx.RepoName != tt.repo || ctx.Subpackage != tt.subpkg || ctx.RepoURL != tt.repoURL {
+				t.Errorf("newContext(%q) = %q, %q, %q, want %q, %q, %q", tt.path, ctx.RepoName, ctx.Subpackage, ctx.RepoURL, tt.repo, tt.subpkg, tt.repoURL)
+			}
+		})
+	}
+
+	// without a repo-root only mapped paths resolve
+	c.RepoRoot = ""
+	if _, ok := newContext(c, "/foo"); ok {
+		t.Errorf("newContext(%q) without repo-root ok = true, want false", "/foo")
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRepoLabels limits the number of distinct repo label values so that
+// requests for arbitrary paths can't grow the metrics without bound
+const maxRepoLabels = 1000
+
+// latencyBuckets are the upper bounds, in seconds, of the request duration
+// histogram
+var latencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+// metrics is a minimal collector that renders the prometheus text exposition
+// format
+type metrics struct {
+	mu             sync.Mutex
+	requests       map[requestKey]uint64
+	repos          map[string]bool
+	latency        map[string]*histogram
+	templateErrors uint64
+	certExpiry     func() (time.Time, bool)
+}
+
+type requestKey struct {
+	repo   string
+	client string
+	code   int
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+var stats = &metrics{}
+
+func (m *metrics) observeRequest(repo, client string, code int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.requests == nil {
+		m.requests = map[requestKey]uint64{}
+		m.repos = map[string]bool{}
+		m.latency = map[string]*histogram{}
+	}
+
+	if !m.repos[repo] {
+		if len(m.repos) >= maxRepoLabels {
+			repo = "other"
+		} else {
+			m.repos[repo] = true
+		}
+	}
+
+	m.requests[requestKey{repo: repo, client: client, code: code}]++
+
+	h, ok := m.latency[client]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latency[client] = h
+	}
+
+	s := d.Seconds()
+	for i, b := range latencyBuckets {
+		if s <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += s
+	h.count++
+}
+
+func (m *metrics) templateError() {
+	m.mu.Lock()
+	m.templateErrors++
+	m.mu.Unlock()
+}
+
+// setCertExpiry registers a function returning the expiry time of the
+// certificate currently being served
+func (m *metrics) setCertExpiry(fn func() (time.Time, bool)) {
+	m.mu.Lock()
+	m.certExpiry = fn
+	m.mu.Unlock()
+}
+
+func (m *metrics) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		bw := bufio.NewWriter(w)
+		m.write(bw)
+		_ = bw.Flush()
+	})
+}
+
+func (m *metrics) write(w *bufio.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP gopkgredir_requests_total Requests handled by repo, client type and status code.")
+	fmt.Fprintln(w, "# TYPE gopkgredir_requests_total counter")
+
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].repo != keys[j].repo {
+			return keys[i].repo < keys[j].repo
+		}
+		if keys[i].client != keys[j].client {
+			return keys[i].client < keys[j].client
+		}
+		return keys[i].code < keys[j].code
+	})
+
+	for _, k := range keys {
+		fmt.Fprintf(w, "gopkgredir_requests_total{repo=%s,client=%s,code=\"%d\"} %d\n",
+			labelValue(k.repo), labelValue(k.client), k.code, m.requests[k])
+	}
+
+	fmt.Fprintln(w, "# HELP gopkgredir_request_duration_seconds Request latency by client type.")
+	fmt.Fprintln(w, "# TYPE gopkgredir_request_duration_seconds histogram")
+
+	clients := make([]string, 0, len(m.latency))
+	for c := range m.latency {
+		clients = append(clients, c)
+	}
+	sort.Strings(clients)
+
+	for _, c := range clients {
+		h := m.latency[c]
+		for i, b := range latencyBuckets {
+			fmt.Fprintf(w, "gopkgredir_request_duration_seconds_bucket{client=%s,le=\"%s\"} %d\n",
+				labelValue(c), strconv.FormatFloat(b, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(w, "gopkgredir_request_duration_seconds_bucket{client=%s,le=\"+Inf\"} %d\n", labelValue(c), h.count)
+		fmt.Fprintf(w, "gopkgredir_request_duration_seconds_sum{client=%s} %s\n", labelValue(c), strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "gopkgredir_request_duration_seconds_count{client=%s} %d\n", labelValue(c), h.count)
+	}
+
+	fmt.Fprintln(w, "# HELP gopkgredir_template_errors_total Errors executing html templates.")
+	fmt.Fprintln(w, "# TYPE gopkgredir_template_errors_total counter")
+	fmt.Fprintf(w, "gopkgredir_template_errors_total %d\n", m.templateErrors)
+
+	if m.certExpiry == nil {
+		return
+	}
+
+	if t, ok := m.certExpiry(); ok {
+		fmt.Fprintln(w, "# HELP gopkgredir_tls_cert_expiry_timestamp_seconds Expiry time of the served tls certificate.")
+		fmt.Fprintln(w, "# TYPE gopkgredir_tls_cert_expiry_timestamp_seconds gauge")
+		fmt.Fprintf(w, "gopkgredir_tls_cert_expiry_timestamp_seconds %d\n", t.Unix())
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelValue(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+// statusRecorder captures the status code written by a handler and the repo
+// the request was resolved to
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	repo   string
+}
+
+// newStatusRecorder wraps w in a statusRecorder unless it already is one so
+// that nested middleware share the same recorded values
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	if r, ok := w.(*statusRecorder); ok {
+		return r
+	}
+	return &statusRecorder{ResponseWriter: w}
+}
+
+// setRepo records the repo a request was resolved to if w is a
+// statusRecorder
+func setRepo(w http.ResponseWriter, repo string) {
+	if r, ok := w.(*statusRecorder); ok {
+		r.repo = repo
+	}
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) code() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// instrument records request metrics for requests served by next
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := newStatusRecorder(w)
+
+		next.ServeHTTP(rec, r)
+
+		stats.observeRequest(rec.repo, clientType(r), rec.code(), time.Since(start))
+	})
+}
+
+// clientType classifies requests as coming from the go tool resolving an
+// import path, the go tool talking to the module proxy or a browser
+func clientType(r *http.Request) string {
+	switch {
+	case r.URL.Query().Get("go-get") == "1":
+		return "go-get"
+	case modProxy != nil && isProxyPath(r.URL.Path):
+		return "proxy"
+	}
+	return "browser"
+}
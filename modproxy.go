@@ -0,0 +1,628 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	proxyVersionDir = "/@v/"
+	proxyLatest     = "/@latest"
+	pseudoTimeFmt   = "20060102150405"
+
+	// maxModuleZipSize is the limit the go tool places on module zips
+	maxModuleZipSize = 500 << 20
+)
+
+// moduleProxy serves the GOPROXY protocol for modules whose repositories are
+// resolved with the same mapping logic used for go-get requests
+type moduleProxy struct {
+	repos *gitRepos
+}
+
+// modProxy is nil unless the module proxy is enabled
+var modProxy *moduleProxy
+
+// module is a single go module within a git repository
+type module struct {
+	path      string
+	repo      *gitRepo
+	codeDir   string
+	tagPrefix string
+	major     string
+
+	// head is the revision @latest falls back to without tags, the major
+	// version branch if one is configured
+	head string
+}
+
+// zipFile is a file of a module zip, name is relative to the module root
+type zipFile struct {
+	name string
+	data []byte
+}
+
+// revInfo is the json body of .info and @latest responses
+type revInfo struct {
+	Version string
+	Time    time.Time
+}
+
+// isProxyPath reports whether path is a GOPROXY protocol request
+func isProxyPath(path string) bool {
+	return strings.Contains(path, proxyVersionDir) || strings.HasSuffix(path, proxyLatest)
+}
+
+// parseProxyPath splits a GOPROXY protocol request path into the unescaped
+// module path and the requested file
+func parseProxyPath(p string) (mod, file string, ok bool) {
+	p = strings.TrimPrefix(p, "/")
+
+	if strings.HasSuffix(p, proxyLatest) {
+		mod, file = strings.TrimSuffix(p, proxyLatest), proxyLatest[1:]
+	} else if i := strings.LastIndex(p, proxyVersionDir); i >= 0 {
+		mod, file = p[:i], p[i+len(proxyVersionDir):]
+	} else {
+		return "", "", false
+	}
+
+	if mod, ok = unescapePath(mod); !ok || len(file) == 0 {
+		return "", "", false
+	}
+
+	return mod, file, true
+}
+
+// unescapePath reverses the case encoding of module paths and versions in
+// proxy urls where each upper case letter is replaced by "!" and its lower
+// case form
+func unescapePath(s string) (string, bool) {
+	var buf strings.Builder
+	bang := false
+
+	for _, r := range s {
+		switch {
+		case 'A' <= r && r <= 'Z':
+			return "", false
+		case bang:
+			if r < 'a' || r > 'z' {
+				return "", false
+			}
+			buf.WriteRune(r - 'a' + 'A')
+			bang = false
+		case r == '!':
+			bang = true
+		default:
+			buf.WriteRune(r)
+		}
+	}
+
+	return buf.String(), !bang
+}
+
+// majorSuffix returns the /vN major version suffix of a module path, if any
+func majorSuffix(modPath string) string {
+	elem := path.Base(modPath)
+	if len(elem) < 2 || elem[0] != 'v' || elem[1] == '0' {
+		return ""
+	}
+
+	n, err := strconv.Atoi(elem[1:])
+	if err != nil || n < 2 {
+		return ""
+	}
+
+	return elem
+}
+
+func newModuleProxy(cacheDir string, interval time.Duration) *moduleProxy {
+	return &moduleProxy{repos: newGitRepos(cacheDir, interval)}
+}
+
+func (p *moduleProxy) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		c, ok := configs.current().config.forHost(r.Host)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		// GOPROXY points at the root of the host so the module path,
+		// including the import prefix, makes up the request path
+		mod, file, ok := parseProxyPath(r.URL.Path)
+		if !ok || !strings.HasPrefix(mod, c.ImportPrefix+"/") {
+			proxyNotFound(w, fmt.Errorf("%s: unknown module", mod))
+			return
+		}
+
+		rel := strings.TrimPrefix(mod, c.ImportPrefix+"/")
+		// only repositories that are known up front are cloned, anything
+		// else below repo-root could make every request clone a new one
+		ctx, ok := newContext(c, rel)
+		if !ok || !ctx.Listed || ctx.VCS != vcsGit {
+			proxyNotFound(w, fmt.Errorf("%s: unknown module", mod))
+			return
+		}
+
+		setRepo(w, ctx.RepoName)
+
+		// repositories that can't be opened are reported as not found so
+		// that the go tool falls back to the next proxy in GOPROXY
+		m, err := p.module(ctx)
+		if err != nil {
+			log.Println("module proxy error", err)
+			proxyNotFound(w, fmt.Errorf("%s: unknown module", mod))
+			return
+		}
+
+		p.serve(w, m, file)
+	})
+}
+
+// module opens the repository backing ctx and describes the module at its
+// subpackage path
+func (p *moduleProxy) module(ctx context) (*module, error) {
+	repo, err := p.repos.open(ctx.CloneURL)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &module{
+		path:    ctx.ImportPrefix + "/" + ctx.RepoName,
+		repo:    repo,
+		codeDir: ctx.Subpackage,
+		head:    "HEAD",
+	}
+
+	if len(ctx.MajorBranch) > 0 {
+		m.head = ctx.MajorBranch
+	}
+
+	if len(ctx.Subpackage) > 0 {
+		m.path += "/" + ctx.Subpackage
+	}
+
+	// tags of modules in a major version subdirectory do not include the
+	// major version element (e.g. "sub/v2.0.0" for "sub/v2")
+	m.major = majorSuffix(m.path)
+	tagDir := m.codeDir
+	if len(m.major) > 0 && path.Base(tagDir) == m.major {
+		tagDir = strings.TrimSuffix(strings.TrimSuffix(tagDir, m.major), "/")
+	}
+
+	if len(tagDir) > 0 {
+		m.tagPrefix = tagDir + "/"
+	}
+
+	return m, nil
+}
+
+func (p *moduleProxy) serve(w http.ResponseWriter, m *module, file string) {
+	if file == proxyLatest[1:] {
+		info, err := m.latest()
+		if err != nil {
+			proxyError(w, err)
+			return
+		}
+		writeJSON(w, info)
+		return
+	}
+
+	if file == "list" {
+		versions, err := m.versions()
+		if err != nil {
+			proxyError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, v := range versions {
+			fmt.Fprintln(w, v)
+		}
+		return
+	}
+
+	ext := path.Ext(file)
+	version, ok := unescapePath(strings.TrimSuffix(file, ext))
+	if !ok {
+		proxyNotFound(w, fmt.Errorf("invalid version %q", file))
+		return
+	}
+
+	rev, info, err := m.stat(version)
+	if err != nil {
+		proxyError(w, err)
+		return
+	}
+
+	switch ext {
+	case ".info":
+		writeJSON(w, info)
+	case ".mod":
+		b, err := m.goMod(rev)
+		if err != nil {
+			proxyError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write(b)
+	case ".zip":
+		b, err := m.zip(rev, info.Version)
+		if err != nil {
+			proxyError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		_, _ = w.Write(b)
+	default:
+		proxyNotFound(w, fmt.Errorf("unknown file %q", file))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("error encoding json", err)
+	}
+}
+
+// proxyNotFound responds with 404 and a plain text explanation which the go
+// tool includes in its error message
+func proxyNotFound(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintln(w, err)
+}
+
+func proxyError(w http.ResponseWriter, err error) {
+	if err == errRevNotFound || os.IsNotExist(err) {
+		proxyNotFound(w, err)
+		return
+	}
+
+	log.Println("module proxy error", err)
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+// compatible reports whether v may be a version of m. Modules without a
+// major version suffix only have v0 and v1 versions.
+func (m *module) compatible(v semver) bool {
+	if len(m.major) == 0 {
+		return v.major <= 1
+	}
+	return "v"+strconv.Itoa(v.major) == m.major
+}
+
+// versions returns the tagged versions of m in ascending order. Without any
+// it fails unless m is a module at the head so that the go tool falls back to
+// a shorter module path.
+func (m *module) versions() ([]string, error) {
+	tags, err := m.repo.tags(m.tagPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := m.filterVersions(tags)
+	if len(sorted) == 0 {
+		hash, _, err := m.repo.commit(m.head)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = m.checkPath(hash); err != nil {
+			return nil, err
+		}
+	}
+
+	ret := make([]string, len(sorted))
+	for i, v := range sorted {
+		ret[i] = v.String()
+	}
+
+	return ret, nil
+}
+
+// filterVersions parses tags and returns the canonical, compatible, non
+// pseudo-versions in ascending order
+func (m *module) filterVersions(tags []string) []semver {
+	var ret []semver
+	for _, t := range tags {
+		v, ok := parseSemver(t)
+		if !ok || v.String() != t || len(v.build) > 0 || v.isPseudo() || !m.compatible(v) {
+			continue
+		}
+		ret = append(ret, v)
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].compare(ret[j]) < 0 })
+	return ret
+}
+
+// stat resolves version to a commit hash
+func (m *module) stat(version string) (string, *revInfo, error) {
+	v, ok := parseSemver(version)
+	if !ok || v.String() != version || len(v.build) > 0 || !m.compatible(v) {
+		return "", nil, errRevNotFound
+	}
+
+	var hash string
+	var t time.Time
+	var err error
+
+	if ts, rev, ok := v.pseudo(); ok {
+		if hash, t, err = m.repo.commit(rev); err != nil {
+			return "", nil, err
+		}
+
+		if !strings.HasPrefix(hash, rev) || t.Format(pseudoTimeFmt) != ts {
+			return "", nil, errRevNotFound
+		}
+	} else if hash, t, err = m.repo.commit("refs/tags/" + m.tagPrefix + version); err != nil {
+		return "", nil, err
+	}
+
+	if err = m.checkPath(hash); err != nil {
+		return "", nil, err
+	}
+
+	return hash, &revInfo{Version: version, Time: t}, nil
+}
+
+// latest returns the highest release, the highest pre-release if there are
+// no releases, or a pseudo-version of the head if there are no tags at all
+func (m *module) latest() (*revInfo, error) {
+	tags, err := m.repo.tags(m.tagPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := m.filterVersions(tags)
+
+	for i := len(versions) - 1; i >= 0; i-- {
+		if len(versions[i].pre) == 0 {
+			_, info, err := m.stat(versions[i].String())
+			return info, err
+		}
+	}
+
+	if len(versions) > 0 {
+		_, info, err := m.stat(versions[len(versions)-1].String())
+		return info, err
+	}
+
+	hash, t, err := m.repo.commit(m.head)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = m.checkPath(hash); err != nil {
+		return nil, err
+	}
+
+	v, err := m.pseudoVersion(hash, t)
+	if err != nil {
+		return nil, err
+	}
+
+	return &revInfo{Version: v, Time: t}, nil
+}
+
+// pseudoVersion returns the pseudo-version of the commit hash based on the
+// highest compatible tag it contains
+func (m *module) pseudoVersion(hash string, t time.Time) (string, error) {
+	tags, err := m.repo.mergedTags(m.tagPrefix, hash)
+	if err != nil {
+		return "", err
+	}
+
+	suffix := t.UTC().Format(pseudoTimeFmt) + "-" + hash[:12]
+	versions := m.filterVersions(tags)
+
+	if len(versions) == 0 {
+		major := 0
+		if len(m.major) > 0 {
+			major, _ = strconv.Atoi(m.major[1:])
+		}
+		return semver{major: major, pre: suffix}.String(), nil
+	}
+
+	base := versions[len(versions)-1]
+	if len(base.pre) > 0 {
+		base.pre += ".0." + suffix
+		return base.String(), nil
+	}
+
+	base.patch++
+	base.pre = "0." + suffix
+	return base.String(), nil
+}
+
+// dir returns the directory of m at rev. Modules with a major version suffix
+// live either in a major version subdirectory or in the directory without it
+// on a major version branch.
+func (m *module) dir(rev string) string {
+	if len(m.major) == 0 || m.repo.exists(rev, path.Join(m.codeDir, "go.mod")) {
+		return m.codeDir
+	}
+
+	if path.Base(m.codeDir) == m.major {
+		return strings.TrimSuffix(strings.TrimSuffix(m.codeDir, m.major), "/")
+	}
+
+	return m.codeDir
+}
+
+// goMod returns the go.mod of m at rev. Only a module at the root of the
+// repository without a major version suffix may lack one, a go.mod is
+// synthesized for it like the go tool does. Any other directory without one
+// is not a module but part of the module above it.
+func (m *module) goMod(rev string) ([]byte, error) {
+	b, err := m.repo.readFile(rev, path.Join(m.dir(rev), "go.mod"))
+	if os.IsNotExist(err) {
+		if len(m.codeDir) == 0 && len(m.major) == 0 {
+			return []byte("module " + m.path + "\n"), nil
+		}
+		return nil, errRevNotFound
+	}
+	return b, err
+}
+
+// checkPath verifies that m is a module at rev and that its go.mod declares
+// m
+func (m *module) checkPath(rev string) error {
+	b, err := m.goMod(rev)
+	if err != nil {
+		return err
+	}
+
+	if p := modulePath(b); len(p) > 0 && p != m.path {
+		return errRevNotFound
+	}
+
+	return nil
+}
+
+// modulePath returns the path declared by the module directive of a go.mod
+func modulePath(gomod []byte) string {
+	for _, line := range strings.Split(string(gomod), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 2 || f[0] != "module" {
+			continue
+		}
+
+		p := f[1]
+		if unq, err := strconv.Unquote(p); err == nil {
+			p = unq
+		}
+		return p
+	}
+	return ""
+}
+
+// zip builds the module zip of m at rev. Files of nested modules, vendored
+// packages and anything but regular files are left out, and the LICENSE of
+// the repository root is added to modules in subdirectories without one.
+func (m *module) zip(rev, version string) ([]byte, error) {
+	dir := m.dir(rev)
+
+	ar, err := m.repo.archive(rev, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []zipFile
+	nested := map[string]bool{}
+
+	tr := tar.NewReader(bytes.NewReader(ar))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimPrefix(hdr.Name, "./")
+		if path.Base(name) == "go.mod" && name != "go.mod" {
+			nested[path.Dir(name)] = true
+		}
+
+		files = append(files, zipFile{name, data})
+	}
+
+	if len(dir) > 0 && !hasFile(files, "LICENSE") {
+		if data, err := m.repo.readFile(rev, "LICENSE"); err == nil {
+			files = append(files, zipFile{"LICENSE", data})
+		}
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	prefix := m.path + "@" + version + "/"
+
+	for _, f := range files {
+		if inNestedModule(f.name, nested) || vendoredPackage(f.name) {
+			continue
+		}
+
+		fw, err := zw.Create(prefix + f.name)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err = fw.Write(f.data); err != nil {
+			return nil, err
+		}
+
+		if buf.Len() > maxModuleZipSize {
+			return nil, fmt.Errorf("%s@%s: module zip exceeds %d bytes", m.path, version, maxModuleZipSize)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func hasFile(files []zipFile, name string) bool {
+	for _, f := range files {
+		if f.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func inNestedModule(name string, nested map[string]bool) bool {
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if nested[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// vendoredPackage reports whether name is a file of a package in a vendor
+// directory, vendor/modules.txt and the like are kept
+func vendoredPackage(name string) bool {
+	elems := strings.Split(name, "/")
+	for i, e := range elems {
+		if e == "vendor" && i < len(elems)-2 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testGit runs git in dir and fails the test on error
+func testGit(t *testing.T, dir string, args ...string) {
+	t.Helper()
+
+	args = append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)
+	if _, err := runGit(dir, args...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testCommit writes files, given as name and content pairs, to dir and
+// commits them
+func testCommit(t *testing.T, dir string, files ...string) {
+	t.Helper()
+
+	for i := 0; i+1 < len(files); i += 2 {
+		name := filepath.Join(dir, filepath.FromSlash(files[i]))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(name, []byte(files[i+1]), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testGit(t, dir, "add", "-A")
+	testGit(t, dir, "commit", "-q", "-m", "commit")
+}
+
+func testInit(t *testing.T, dir string) {
+	t.Helper()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	testGit(t, dir, "init", "-q")
+}
+
+// TestModuleLayouts checks the module directory and tag prefix the proxy
+// uses for each go modules layout
+func TestModuleLayouts(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+
+	tmp, err := ioutil.TempDir("", "gopkgredir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(tmp) }()
+
+	// major subdirectory and nested modules
+	sub := filepath.Join(tmp, "sub")
+	testInit(t, sub)
+	testCommit(t, sub,
+		"go.mod", "module example.com/sub\n",
+		"sub.go", "package sub\n",
+		"v2/go.mod", "module example.com/sub/v2\n",
+		"v2/sub.go", "package sub\n",
+		"tools/go.mod", "module example.com/sub/tools\n",
+		"tools/tools.go", "package tools\n",
+		"docs/doc.go", "package docs\n",
+	)
+	testGit(t, sub, "tag", "v1.0.0")
+	testGit(t, sub, "tag", "v2.0.0")
+	testGit(t, sub, "tag", "tools/v1.0.0")
+
+	// major branch
+	br := filepath.Join(tmp, "br")
+	testInit(t, br)
+	testCommit(t, br, "go.mod", "module example.com/br\n", "br.go", "package br\n")
+	testGit(t, br, "tag", "v1.0.0")
+	testGit(t, br, "checkout", "-q", "-b", "v2")
+	testCommit(t, br, "go.mod", "module example.com/br/v2\n")
+	testGit(t, br, "tag", "v2.0.0")
+	testGit(t, br, "checkout", "-q", "-")
+
+	// separate repository
+	sep := filepath.Join(tmp, "sep-v2")
+	testInit(t, sep)
+	testCommit(t, sep, "go.mod", "module example.com/sep/v2\n", "sep.go", "package sep\n")
+	testGit(t, sep, "tag", "v2.1.0")
+
+	c := config{
+		ImportPrefix: "example.com",
+		VCS:          vcsGit,
+		Mappings: []mapping{
+			{Path: "sub", Repo: sub, Majors: []majorVersion{{Major: 2}}},
+			{Path: "br", Repo: br, Majors: []majorVersion{{Major: 2, Branch: "v2"}}},
+			{Path: "sep", Repo: filepath.Join(tmp, "sep"), Majors: []majorVersion{{Major: 2, Repo: sep}}},
+		},
+	}
+
+	p := newModuleProxy(filepath.Join(tmp, "cache"), time.Minute)
+
+	tests := []struct {
+		name      string
+		path      string
+		version   string
+		module    string
+		tagPrefix string
+		dir       string
+		head      string
+	}{
+		{name: "repository root", path: "sub", version: "v1.0.0", module: "example.com/sub", head: "HEAD"},
+		{name: "major subdirectory", path: "sub/v2", version: "v2.0.0", module: "example.com/sub/v2", dir: "v2", head: "HEAD"},
+		{name: "nested module", path: "sub/tools", version: "v1.0.0", module: "example.com/sub/tools", tagPrefix: "tools/", dir: "tools", head: "HEAD"},
+		{name: "major branch", path: "br/v2", version: "v2.0.0", module: "example.com/br/v2", head: "v2"},
+		{name: "separate repository", path: "sep/v2", version: "v2.1.0", module: "example.com/sep/v2", head: "HEAD"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, ok := newContext(c, tt.path)
+			if !ok {
+				t.Fatalf("newContext(%q) ok = false", tt.path)
+			}
+
+			m, err := p.module(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if m.path != tt.module || m.tagPrefix != tt.tagPrefix || m.head != tt.head {
+				t.Errorf("module = %q, tag prefix %q, head %q, want %q, %q, %q", m.path, m.tagPrefix, m.head, tt.module, tt.tagPrefix, tt.head)
+			}
+
+			rev, _, err := m.stat(tt.version)
+			if err != nil {
+				t.Fatalf("stat(%q): %v", tt.version, err)
+			}
+
+			if dir := m.dir(rev); dir != tt.dir {
+				t.Errorf("dir = %q, want %q", dir, tt.dir)
+			}
+
+			info, err := m.latest()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if info.Version != tt.version {
+				t.Errorf("latest = %q, want %q", info.Version, tt.version)
+			}
+		})
+	}
+
+	// a directory without a go.mod is part of the module above it, the go
+	// tool must fall back to the shorter module path
+	for _, path := range []string{"sub/docs", "sub/nonexistent"} {
+		ctx, _ := newContext(c, path)
+
+		m, err := p.module(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = m.latest(); err != errRevNotFound {
+			t.Errorf("%s: latest error = %v, want %v", path, err, errRevNotFound)
+		}
+
+		if _, err = m.versions(); err != errRevNotFound {
+			t.Errorf("%s: versions error = %v, want %v", path, err, errRevNotFound)
+		}
+	}
+}
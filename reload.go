@@ -0,0 +1,209 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// snapshot is the reloadable part of the configuration. Requests load it once
+// so that they are served from a consistent view even if a reload happens
+// concurrently.
+type snapshot struct {
+	config config
+	html   *template.Template
+}
+
+// configLoader builds snapshots from the mapping file, the config file, the
+// allowlist and the templates on top of the settings that are only read at
+// startup, and swaps them atomically whenever the files change or SIGHUP is
+// received. If a new snapshot fails to load or validate, the previous one
+// continues to be served.
+type configLoader struct {
+	base config
+
+	snap atomic.Value // *snapshot
+	mods map[string]fileVersion
+}
+
+var configs *configLoader
+
+func newConfigLoader(base config) (*configLoader, error) {
+	l := configLoader{base: base}
+
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+
+	return &l, nil
+}
+
+// files returns the files a snapshot is loaded from
+func (l *configLoader) files() []string {
+	var ret []string
+	for _, name := range []string{l.base.ConfigFile, l.base.MappingFile} {
+		if len(name) > 0 {
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
+
+func (l *configLoader) reload() error {
+	// remember the attempted versions even on failure so that a bad file is
+	// only retried once it changes again
+	mods := map[string]fileVersion{}
+	for _, name := range l.files() {
+		mod, err := statFile(name)
+		if err != nil {
+			return err
+		}
+		mods[name] = mod
+	}
+
+	// templates may be added or removed at any time, missing ones are
+	// recorded with a zero version
+	for _, name := range l.templateFiles() {
+		mods[name], _ = statFile(name)
+	}
+
+	l.mods = mods
+
+	s, err := loadSnapshot(l.base)
+	if err != nil {
+		return err
+	}
+
+	l.snap.Store(s)
+	return nil
+}
+
+// templateFiles returns the template files that replace built in templates
+// if they exist
+func (l *configLoader) templateFiles() []string {
+	if len(l.base.TemplatesDir) == 0 {
+		return nil
+	}
+
+	ret := make([]string, len(templateNames))
+	for i, name := range templateNames {
+		ret[i] = templateFile(l.base.TemplatesDir, name)
+	}
+	return ret
+}
+
+// changed reports whether any file differs from the last loaded version
+func (l *configLoader) changed() bool {
+	for _, name := range l.files() {
+		mod, err := statFile(name)
+		if err != nil {
+			continue
+		}
+
+		if mod != l.mods[name] {
+			return true
+		}
+	}
+
+	for _, name := range l.templateFiles() {
+		if mod, _ := statFile(name); mod != l.mods[name] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// current returns the snapshot requests should be served with
+func (l *configLoader) current() *snapshot {
+	return l.snap.Load().(*snapshot)
+}
+
+// watch reloads the configuration on SIGHUP and, if interval is non-zero,
+// whenever polling detects that the files have changed. It never returns.
+func (l *configLoader) watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	for {
+		select {
+		case <-hup:
+			log.Printf("received SIGHUP, reloading configuration")
+		case <-tick:
+			if !l.changed() {
+				continue
+			}
+			log.Printf("configuration files changed, reloading")
+		}
+
+		if err := l.reload(); err != nil {
+			log.Printf("error reloading configuration, keeping previous: %v", err)
+			continue
+		}
+
+		c := l.current().config
+		log.Printf("reloaded configuration (%d mappings, %d hosts)", len(c.Mappings), len(c.Hosts))
+	}
+}
+
+// loadSnapshot loads the mappings, hosts and allowlist from the config file
+// and mapping file and parses the templates, replacing the built in ones with
+// those in the templates dir
+func loadSnapshot(base config) (*snapshot, error) {
+	c := base
+	c.Mappings, c.Hosts = nil, nil
+	c.Allowlist = splitList(allowlist)
+
+	if len(c.ConfigFile) > 0 {
+		fc, err := loadConfigFileLists(c.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Mappings = fc.Mappings
+		c.Hosts = fc.Hosts
+
+		if fc.Allowlist != nil {
+			c.Allowlist = fc.Allowlist
+		}
+	}
+
+	if len(c.MappingFile) > 0 {
+		mf, err := loadMappingFile(c.MappingFile)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Mappings = append(c.Mappings, mf.Mappings...)
+		c.Hosts = append(c.Hosts, mf.Hosts...)
+		c.Allowlist = append(c.Allowlist, mf.Allow...)
+	}
+
+	// mappings and hosts may come from both files, validating them together
+	// catches duplicates between the two
+	if err := validateMappings(c.Mappings); err != nil {
+		return nil, err
+	}
+
+	if err := validateHosts(c.Hosts); err != nil {
+		return nil, err
+	}
+
+	tpl, err := loadTemplates(c.TemplatesDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &snapshot{config: c, html: tpl}, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// semver is a parsed semantic version of the form
+// vMAJOR.MINOR.PATCH[-PRERELEASE][+BUILD] as used by go modules
+type semver struct {
+	major, minor, patch int
+	pre                 string
+	build               string
+}
+
+func parseSemver(v string) (semver, bool) {
+	var sv semver
+
+	if !strings.HasPrefix(v, "v") {
+		return sv, false
+	}
+	v = v[1:]
+
+	if i := strings.IndexByte(v, '+'); i >= 0 {
+		sv.build = v[i+1:]
+		v = v[:i]
+
+		if !validIdents(sv.build) {
+			return sv, false
+		}
+	}
+
+	if i := strings.IndexByte(v, '-'); i >= 0 {
+		sv.pre = v[i+1:]
+		v = v[:i]
+
+		if !validIdents(sv.pre) {
+			return sv, false
+		}
+	}
+
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return sv, false
+	}
+
+	nums := make([]int, 3)
+	for i, p := range parts {
+		if len(p) == 0 || (len(p) > 1 && p[0] == '0') {
+			return sv, false
+		}
+
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return sv, false
+		}
+		nums[i] = n
+	}
+
+	sv.major, sv.minor, sv.patch = nums[0], nums[1], nums[2]
+	return sv, true
+}
+
+func validIdents(s string) bool {
+	for _, id := range strings.Split(s, ".") {
+		if len(id) == 0 {
+			return false
+		}
+
+		for _, r := range id {
+			if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (v semver) String() string {
+	s := "v" + strconv.Itoa(v.major) + "." + strconv.Itoa(v.minor) + "." + strconv.Itoa(v.patch)
+
+	if len(v.pre) > 0 {
+		s += "-" + v.pre
+	}
+
+	if len(v.build) > 0 {
+		s += "+" + v.build
+	}
+
+	return s
+}
+
+// compare returns -1, 0 or 1 comparing v to o by semver precedence, ignoring
+// build metadata
+func (v semver) compare(o semver) int {
+	for _, d := range []int{v.major - o.major, v.minor - o.minor, v.patch - o.patch} {
+		if d < 0 {
+			return -1
+		}
+		if d > 0 {
+			return 1
+		}
+	}
+
+	switch {
+	case v.pre == o.pre:
+		return 0
+	case len(v.pre) == 0:
+		return 1
+	case len(o.pre) == 0:
+		return -1
+	}
+
+	a, b := strings.Split(v.pre, "."), strings.Split(o.pre, ".")
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := compareIdent(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+
+	return 0
+}
+
+func compareIdent(a, b string) int {
+	an, aErr := strconv.Atoi(a)
+	bn, bErr := strconv.Atoi(b)
+
+	switch {
+	case aErr == nil && bErr == nil:
+		switch {
+		case an < bn:
+			return -1
+		case an > bn:
+			return 1
+		}
+		return 0
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+
+	return strings.Compare(a, b)
+}
+
+// isPseudo reports whether v is a pseudo-version
+func (v semver) isPseudo() bool {
+	_, _, ok := v.pseudo()
+	return ok
+}
+
+// pseudo returns the commit timestamp (yyyymmddhhmmss) and abbreviated commit
+// hash of a pseudo-version
+func (v semver) pseudo() (ts, rev string, ok bool) {
+	i := strings.LastIndexByte(v.pre, '-')
+	if i < 0 {
+		return "", "", false
+	}
+
+	rev = v.pre[i+1:]
+	ts = v.pre[:i]
+
+	if j := strings.LastIndexByte(ts, '.'); j >= 0 {
+		ts = ts[j+1:]
+	}
+
+	if len(rev) != 12 || len(ts) != 14 {
+		return "", "", false
+	}
+
+	for _, r := range ts {
+		if r < '0' || r > '9' {
+			return "", "", false
+		}
+	}
+
+	return ts, rev, true
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	stdcontext "context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var errShuttingDown = errors.New("shutting down")
+
+// servers tracks the running http servers so that they can all be shut down
+// together
+type servers struct {
+	list  []*http.Server
+	errCh chan error
+}
+
+func newServers() *servers {
+	return &servers{errCh: make(chan error, 4)}
+}
+
+// start runs srv in the background, serving tls if srv has a tls config.
+// Errors other than http.ErrServerClosed are reported by wait.
+func (s *servers) start(srv *http.Server) {
+	s.list = append(s.list, srv)
+
+	go func() {
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+
+		if err != http.ErrServerClosed {
+			s.errCh <- err
+		}
+	}()
+}
+
+// wait blocks until a server fails or SIGTERM or SIGINT is received. On a
+// signal, readiness is marked as failing and, after delay, the servers stop
+// accepting connections and in-flight requests are drained for up to timeout.
+func (s *servers) wait(delay, timeout time.Duration) error {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err := <-s.errCh:
+		return err
+	case v := <-sig:
+		log.Printf("received %s, shutting down", v)
+	}
+
+	readiness.add("shutdown", func() error { return errShuttingDown })
+
+	if delay > 0 {
+		log.Printf("waiting %s before closing listeners", delay)
+		time.Sleep(delay)
+	}
+
+	ctx, cancel := stdcontext.WithTimeout(stdcontext.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(s.list))
+
+	for _, srv := range s.list {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				errs <- err
+			}
+		}(srv)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	log.Printf("shutdown complete")
+	return nil
+}
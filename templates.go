@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Templates in the templates-dir replace the built in template of the same
+// name, any that are missing fall back to the built in one. Each file may
+// {{define}} additional templates for the others to use.
+//
+//	meta.html      the go-import and go-source meta tags, included by the
+//	               others with {{template "meta" .}}
+//	go-get.html    served to the go tool for ?go-get=1 requests
+//	page.html      served to browsers when the browser mode is "page"
+//	redirect.html  written by export when the browser mode is "redirect"
+//	404.html       served to browsers for unknown or invalid packages
+//	index.html     served to browsers requesting the root path
+//
+// All but 404.html are executed with a context. In addition to the settings
+// of the host the request was made to, such as .ImportPrefix and .RepoRoot,
+// it holds:
+//
+//	.RepoName     the vanity path of the repository, e.g. "foo" or "team/foo"
+//	.Subpackage   the path of the requested package within the repository
+//	.Listed       whether the repository is mapped, discovered or allowlisted
+//	              rather than only allowed because there is no allowlist
+//	.SourceRoot   the vanity path the go-source urls are relative to, the
+//	              repository or, on a major version branch, the /vN path
+//	.MajorBranch  the branch of the requested major version, if configured
+//	.VCS          the repository type, e.g. "git"
+//	.RepoURL      the url the go tool clones from, or the module proxy url
+//	              if .VCS is "mod"
+//	.CompanionURL the git repository announced next to a module proxy, if any
+//	.RedirectURL  the url browsers are sent to
+//	.Browser      the browser mode, "redirect" or "page"
+//	.Source       the go-source urls (.Home, .Dir and .File), nil if disabled
+//	.ImportPath   the full import path of the requested package
+//	.DocURL       the documentation url of the package, empty if disabled
+//	.License      the license of the mapping, if any
+//	.LatestTag    the highest semver tag of the repository, only set for
+//	              page.html and if it could be determined
+//
+// 404.html is executed with a notFoundData and index.html with an indexData.
+
+// templateNames are the templates that may be replaced from templates-dir
+var templateNames = []string{
+	metaTplName,
+	goGetTplName,
+	pageTplName,
+	redirectTplName,
+	notFoundTplName,
+	indexTplName,
+}
+
+var builtinTemplates = map[string]string{
+	metaTplName:     metaTpl,
+	goGetTplName:    goGetTpl,
+	pageTplName:     pageTpl,
+	redirectTplName: redirectTpl,
+	notFoundTplName: notFoundTpl,
+	indexTplName:    indexTpl,
+}
+
+// notFoundData is the data 404.html is executed with
+type notFoundData struct {
+	// ImportPrefix is the import prefix of the host the request was made to
+	ImportPrefix string
+
+	// Path is the requested path relative to ImportPrefix, it is empty in
+	// the 404.html written by export
+	Path string
+}
+
+// templateFile returns the file in dir that replaces the template name
+func templateFile(dir, name string) string {
+	return filepath.Join(dir, name+".html")
+}
+
+// loadTemplates parses the built in html templates, replacing any that have
+// a file in dir if dir is not empty
+func loadTemplates(dir string) (*template.Template, error) {
+	tpl := template.New("")
+
+	for _, name := range templateNames {
+		text, src := builtinTemplates[name], "built in"
+
+		if len(dir) > 0 {
+			file := templateFile(dir, name)
+			b, err := ioutil.ReadFile(file)
+			if err == nil {
+				text, src = string(b), file
+			} else if !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+
+		if _, err := tpl.New(name).Parse(text); err != nil {
+			return nil, fmt.Errorf("%s: %v", src, err)
+		}
+	}
+
+	return tpl, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+)
+
+// validImportPath reports whether path, relative to the import prefix, is a
+// syntactically valid go import path. Each element must be non-empty, consist
+// only of ASCII letters, digits and "-._~+" and may not begin or end with a
+// dot.
+func validImportPath(path string) bool {
+	if len(path) == 0 {
+		return false
+	}
+
+	for _, elem := range strings.Split(path, "/") {
+		if !validPathElem(elem) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func validPathElem(elem string) bool {
+	if len(elem) == 0 || elem[0] == '.' || elem[len(elem)-1] == '.' {
+		return false
+	}
+
+	for _, r := range elem {
+		switch {
+		case 'a' <= r && r <= 'z',
+			'A' <= r && r <= 'Z',
+			'0' <= r && r <= '9',
+			strings.ContainsRune("-._~+", r):
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// reservedNames are files browsers and crawlers request on every site, they
+// are never served from repo-root unless allowlisted
+var reservedNames = map[string]bool{
+	"favicon.ico":                      true,
+	"robots.txt":                       true,
+	"sitemap.xml":                      true,
+	"humans.txt":                       true,
+	"ads.txt":                          true,
+	"apple-touch-icon.png":             true,
+	"apple-touch-icon-precomposed.png": true,
+}
+
+// allowed reports whether repo may be served by appending it to repo-root.
+// Without a repo-root nothing is, and with an allowlist only the repos it
+// lists are. With discovery and no allowlist none are, discovered repos are
+// served by their mappings instead. Otherwise any valid name but the reserved
+// ones is.
+func (c config) allowed(repo string) bool {
+	if len(c.RepoRoot) == 0 {
+		return false
+	}
+
+	if len(c.Allowlist) == 0 {
+		return len(c.Discovery) == 0 && !reservedNames[repo]
+	}
+
+	for _, a := range c.Allowlist {
+		if a == repo {
+			return true
+		}
+	}
+
+	return false
+}
+
+func splitList(list string) []string {
+	var ret []string
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); len(s) > 0 {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// The repository types the go tool understands in go-import meta tags. mod
+// is not a version control system but a module proxy serving the modules
+// below the import path.
+const (
+	vcsGit    = "git"
+	vcsHg     = "hg"
+	vcsSvn    = "svn"
+	vcsBzr    = "bzr"
+	vcsFossil = "fossil"
+	vcsMod    = "mod"
+)
+
+// vcsConvention holds the defaults that depend on the repository type
+type vcsConvention struct {
+	// Branch is the default branch used in go-source urls
+	Branch string
+
+	// Source is the go-source layout used if none is configured, empty to
+	// detect it from the repo url
+	Source string
+
+	// Shared is set if all repositories are served from repo-root itself
+	// rather than from a url below it
+	Shared bool
+}
+
+var vcsConventions = map[string]vcsConvention{
+	vcsGit:    {Branch: "master"},
+	vcsHg:     {Branch: "default", Source: sourceHgweb},
+	vcsSvn:    {Branch: "trunk", Source: sourceNone},
+	vcsBzr:    {Branch: "trunk", Source: sourceNone},
+	vcsFossil: {Branch: "trunk", Source: sourceFossil},
+	vcsMod:    {Source: sourceNone, Shared: true},
+}
+
+func validVCS(name string) error {
+	if _, ok := vcsConventions[name]; !ok {
+		return fmt.Errorf("vcs must be one of %q, %q, %q, %q, %q or %q", vcsGit, vcsHg, vcsSvn, vcsBzr, vcsFossil, vcsMod)
+	}
+	return nil
+}
+
+// vcsRepoURL returns the url of the repository name below root
+func vcsRepoURL(vcs, root, name string) string {
+	if vcsConventions[vcs].Shared {
+		return root
+	}
+	return root + "/" + name
+}
+
+// validProxyURL checks that u can be used as the base url of a module proxy
+// in a go-import tag of type mod
+func validProxyURL(u string) error {
+	p, err := url.Parse(u)
+	if err != nil {
+		return fmt.Errorf("invalid proxy url %q: %v", u, err)
+	}
+
+	if (p.Scheme != "https" && p.Scheme != "http") || len(p.Host) == 0 {
+		return fmt.Errorf("proxy url %q must be an absolute http or https url", u)
+	}
+
+	if len(p.RawQuery) > 0 || len(p.Fragment) > 0 || p.User != nil {
+		return fmt.Errorf("proxy url %q must not have credentials, a query or a fragment", u)
+	}
+
+	return nil
+}
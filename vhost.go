@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	unknownHostDefault  = "default"
+	unknownHostNotFound = "404"
+)
+
+// vhost overrides the global configuration for requests with a matching Host
+// header. Any field left empty falls back to the global configuration, except
+// for Mappings which are never inherited.
+type vhost struct {
+	// Host is the hostname, without port, the vhost is selected by
+	Host string `json:"host"`
+
+	// ImportPrefix defaults to Host
+	ImportPrefix string    `json:"import_prefix,omitempty"`
+	VCS          string    `json:"vcs,omitempty"`
+	RepoRoot     string    `json:"repo_root,omitempty"`
+	RedirectRoot string    `json:"redirect_root,omitempty"`
+	Source       string    `json:"source,omitempty"`
+	SourceBranch string    `json:"source_branch,omitempty"`
+	Browser      string    `json:"browser,omitempty"`
+	Allow        []string  `json:"allow,omitempty"`
+	Mappings     []mapping `json:"mappings,omitempty"`
+
+	// Discovery lists the repositories below RepoRoot, it requires RepoRoot
+	// to differ from that of the global configuration to discover another
+	// organization or group
+	Discovery      string `json:"discovery,omitempty"`
+	DiscoveryURL   string `json:"discovery_url,omitempty"`
+	DiscoveryToken string `json:"discovery_token,omitempty"`
+}
+
+// validateHosts normalizes and validates hosts in place
+func validateHosts(hosts []vhost) error {
+	seen := map[string]bool{}
+	for i, h := range hosts {
+		h.Host = strings.ToLower(h.Host)
+
+		if len(h.Host) == 0 {
+			return fmt.Errorf("host %d: host is required", i)
+		}
+
+		if seen[h.Host] {
+			return fmt.Errorf("host %q: duplicate host", h.Host)
+		}
+		seen[h.Host] = true
+
+		if len(h.ImportPrefix) == 0 {
+			h.ImportPrefix = h.Host
+		}
+
+		if len(h.VCS) > 0 {
+			if err := validVCS(h.VCS); err != nil {
+				return fmt.Errorf("host %q: %v", h.Host, err)
+			}
+		}
+
+		if h.VCS == vcsMod && len(h.RepoRoot) > 0 {
+			if err := validProxyURL(h.RepoRoot); err != nil {
+				return fmt.Errorf("host %q: %v", h.Host, err)
+			}
+		}
+
+		if err := validSource(h.Source); err != nil {
+			return fmt.Errorf("host %q: %v", h.Host, err)
+		}
+
+		if len(h.Browser) > 0 {
+			if err := validBrowser(h.Browser); err != nil {
+				return fmt.Errorf("host %q: %v", h.Host, err)
+			}
+		}
+
+		if err := validDiscovery(h.Discovery); err != nil {
+			return fmt.Errorf("host %q: %v", h.Host, err)
+		}
+
+		if err := validateMappings(h.Mappings); err != nil {
+			return fmt.Errorf("host %q: %v", h.Host, err)
+		}
+
+		hosts[i] = h
+	}
+
+	return nil
+}
+
+// hostname returns the lowercased host of a Host header without any port
+func hostname(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		hostport = host
+	}
+	return strings.ToLower(strings.TrimSuffix(hostport, "."))
+}
+
+// importHost returns the hostname part of an import prefix
+func importHost(prefix string) string {
+	return strings.ToLower(strings.SplitN(prefix, "/", 2)[0])
+}
+
+// forHost returns the configuration to use for requests to host. ok is false
+// if host is unknown and unknown-host is set to 404.
+func (c config) forHost(host string) (ret config, ok bool) {
+	host = hostname(host)
+
+	for _, h := range c.Hosts {
+		if h.Host != host {
+			continue
+		}
+
+		ret = c
+		ret.ImportPrefix = h.ImportPrefix
+		ret.Mappings = h.Mappings
+
+		if len(h.VCS) > 0 {
+			ret.VCS = h.VCS
+		}
+
+		if len(h.RepoRoot) > 0 {
+			ret.RepoRoot = h.RepoRoot
+		}
+
+		if len(h.RedirectRoot) > 0 {
+			ret.RedirectRoot = h.RedirectRoot
+		}
+
+		if len(h.Source) > 0 {
+			ret.Source = h.Source
+		}
+
+		if len(h.SourceBranch) > 0 {
+			ret.SourceBranch = h.SourceBranch
+		}
+
+		if len(h.Browser) > 0 {
+			ret.Browser = h.Browser
+		}
+
+		if len(h.Allow) > 0 {
+			ret.Allowlist = h.Allow
+		}
+
+		if len(h.Discovery) > 0 {
+			ret.Discovery = h.Discovery
+			ret.DiscoveryURL = h.DiscoveryURL
+			ret.DiscoveryToken = h.DiscoveryToken
+		}
+
+		return ret, true
+	}
+
+	if len(c.Hosts) == 0 || c.UnknownHost != unknownHostNotFound || host == importHost(c.ImportPrefix) {
+		return c, true
+	}
+
+	return c, false
+}